@@ -0,0 +1,99 @@
+package ipmon
+
+import (
+	"net"
+)
+
+// Clone returns a deep copy of u that stays the same when the monitor
+// moves on, so that it can be kept across later updates. The netlink
+// objects behind interfaces and routes are shared, they are never
+// modified.
+func (u *Update) Clone() *Update {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.Change = append([]string(nil), u.Change...)
+	c.ChangedInterfaces = append([]string(nil), u.ChangedInterfaces...)
+	c.RemovedInterfaces = append([]string(nil), u.RemovedInterfaces...)
+	c.Address = u.Address.clone()
+	c.OldAddress = u.OldAddress.clone()
+	c.DelegatedPrefixes = append([]string(nil), u.DelegatedPrefixes...)
+	if u.Raw != nil {
+		raw := *u.Raw
+		raw.Flags = append([]string(nil), u.Raw.Flags...)
+		c.Raw = &raw
+	}
+	if u.Routes != nil {
+		c.Routes = make([]*Route, len(u.Routes))
+		for i, r := range u.Routes {
+			rc := *r
+			c.Routes[i] = &rc
+		}
+	}
+	if u.Rules != nil {
+		c.Rules = make([]*Rule, len(u.Rules))
+		for i, r := range u.Rules {
+			rc := *r
+			c.Rules[i] = &rc
+		}
+	}
+	if u.Neighbors != nil {
+		c.Neighbors = make([]*Neighbor, len(u.Neighbors))
+		for i, n := range u.Neighbors {
+			nc := *n
+			c.Neighbors[i] = &nc
+		}
+	}
+	if u.Interfaces != nil {
+		c.Interfaces = make(map[string]*Interface, len(u.Interfaces))
+		for n, inf := range u.Interfaces {
+			c.Interfaces[n] = inf.clone()
+		}
+	}
+	if u.linkNames != nil {
+		c.linkNames = make(map[int]string, len(u.linkNames))
+		for i, n := range u.linkNames {
+			c.linkNames[i] = n
+		}
+	}
+	c.order = append([]string(nil), u.order...)
+	return &c
+}
+
+func (inf *Interface) clone() *Interface {
+	if inf == nil {
+		return nil
+	}
+	c := *inf
+	if inf.Addr != nil {
+		c.Addr = make([]*Address, len(inf.Addr))
+		for i, a := range inf.Addr {
+			c.Addr[i] = a.clone()
+		}
+	}
+	if inf.WireGuard != nil {
+		wg := *inf.WireGuard
+		c.WireGuard = &wg
+	}
+	if inf.Stats != nil {
+		st := *inf.Stats
+		c.Stats = &st
+	}
+	return &c
+}
+
+func (a *Address) clone() *Address {
+	if a == nil {
+		return nil
+	}
+	c := *a
+	if a.N.IPNet != nil {
+		ipNet := net.IPNet{
+			IP:   append(net.IP(nil), a.N.IP...),
+			Mask: append(net.IPMask(nil), a.N.Mask...),
+		}
+		c.N.IPNet = &ipNet
+	}
+	return &c
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// hookBackoff tracks consecutive failures per hook. Once a hook has failed
+// after times in a row it is delayed for a time that doubles with every
+// further failure, up to max, and then runs for the latest update it
+// missed. A successful run resets the hook. It is safe for use by
+// concurrent workers.
+type hookBackoff struct {
+	mu    sync.Mutex
+	after int
+	max   time.Duration
+	hooks map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	until    time.Time
+	// pending runs the hook for the latest update that arrived while it
+	// was backed off, timer calls it when the delay expires
+	pending func()
+	timer   *time.Timer
+}
+
+func newHookBackoff(after int, max time.Duration) *hookBackoff {
+	return &hookBackoff{
+		after: after,
+		max:   max,
+		hooks: map[string]*backoffState{},
+	}
+}
+
+// wait returns how long name is still backed off, zero when it may run
+func (b *hookBackoff) wait(name string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.hooks[name]
+	if b.after <= 0 || st == nil {
+		return 0
+	}
+	if d := time.Until(st.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// delay makes run the pending run of name, replacing an earlier one, and
+// arranges for it to be called once name is no longer backed off
+func (b *hookBackoff) delay(name string, run func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.hooks[name]
+	if st == nil {
+		return
+	}
+	st.pending = run
+	if st.timer == nil {
+		st.timer = time.AfterFunc(time.Until(st.until), func() {
+			b.mu.Lock()
+			run := st.pending
+			st.pending = nil
+			st.timer = nil
+			b.mu.Unlock()
+			if run != nil {
+				run()
+			}
+		})
+	}
+}
+
+// done records the result of running name and returns the delay before
+// it runs again, zero unless it failed too many times in a row
+func (b *hookBackoff) done(name string, ok bool) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.after <= 0 {
+		return 0
+	}
+	st := b.hooks[name]
+	if st != nil && st.timer != nil {
+		// the hook ran for a newer update than the pending one
+		st.timer.Stop()
+		st.timer = nil
+		st.pending = nil
+	}
+	if ok {
+		delete(b.hooks, name)
+		return 0
+	}
+	if st == nil {
+		st = &backoffState{}
+		b.hooks[name] = st
+	}
+	st.failures++
+	if st.failures < b.after {
+		return 0
+	}
+	d := time.Second
+	for i := b.after; i < st.failures && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	st.until = time.Now().Add(d)
+	return d
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig reads a TOML style configuration file where every key is the
+// name of a command line flag. Flags given on the command line take
+// precedence over values from the file. The special key "command" holds
+// the hook command and its arguments and is returned to the caller.
+//
+// Only a flat subset of TOML is supported: strings, booleans, numbers,
+// durations and single line arrays.
+func loadConfig(fs *flag.FlagSet, path string) (command []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	lineNo := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: tables are not supported", path, lineNo)
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		values, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, lineNo, key, err)
+		}
+
+		if key == "command" {
+			command = values
+			continue
+		}
+		fl := fs.Lookup(key)
+		if fl == nil || key == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, lineNo, key)
+		}
+		if set[key] {
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(key, v); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, lineNo, key, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// stripComment removes a trailing # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+	if !strings.HasPrefix(raw, "[") {
+		v, err := parseConfigScalar(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+	if !strings.HasSuffix(raw, "]") {
+		return nil, fmt.Errorf("unterminated array")
+	}
+	var values []string
+	rest := strings.TrimSpace(raw[1 : len(raw)-1])
+	for rest != "" {
+		item, tail := splitArrayItem(rest)
+		v, err := parseConfigScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		rest = strings.TrimSpace(tail)
+	}
+	return values, nil
+}
+
+// splitArrayItem returns the first comma separated item of an array body
+// and whatever follows the comma
+func splitArrayItem(s string) (string, string) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func parseConfigScalar(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.ContainsAny(raw, " \t\"'"):
+		return "", fmt.Errorf("invalid value %q", raw)
+	}
+	return raw, nil
+}
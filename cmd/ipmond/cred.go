@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hookUser is the user and group hooks run as with -drop-priv-for-hook
+type hookUser struct {
+	cred *syscall.Credential
+	// name and home replace USER, LOGNAME and HOME of the daemon in the
+	// environment of hooks
+	name string
+	home string
+}
+
+// parseHookUser looks up spec given as user or user:group, names and
+// numeric ids are accepted. Without a group the primary group of the user
+// is used. Supplementary groups are dropped.
+func parseHookUser(spec string) (*hookUser, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("unknown group %q", group)
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &hookUser{
+		cred: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		name: u.Username,
+		home: u.HomeDir,
+	}, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"strings"
+)
+
+// envFileQuoter escapes the characters that are special inside double
+// quotes for systemd's EnvironmentFile= as well as for a shell
+var envFileQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+// writeEnvFile atomically replaces path with the variables of upd in the
+// format of systemd's EnvironmentFile=, values are double quoted and lists
+// joined with sep
+func writeEnvFile(path string, upd *ipmon.Update, sep string) error {
+	var b strings.Builder
+	for _, kv := range upd.MarshalEnvSep(sep) {
+		k, v, _ := strings.Cut(kv, "=")
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(envFileQuoter.Replace(v))
+		b.WriteString("\"\n")
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
@@ -0,0 +1,36 @@
+module bonan.se/ipmon/cmd/ipmond
+
+go 1.20
+
+require (
+	bonan.se/ipmon v0.0.0
+	bonan.se/ipmon/ipmonpb v0.0.0
+	bonan.se/ipmon/wireguard v0.0.0
+	github.com/vishvananda/netlink v1.3.0
+	golang.org/x/sys v0.13.0
+	google.golang.org/grpc v1.58.3
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/josharian/native v1.1.0 // indirect
+	github.com/mdlayher/genetlink v1.3.2 // indirect
+	github.com/mdlayher/netlink v1.7.2 // indirect
+	github.com/mdlayher/socket v0.4.1 // indirect
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	golang.zx2c4.com/wireguard v0.0.0-20230325221338-052af4a8072b // indirect
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+replace (
+	bonan.se/ipmon => ../../
+	bonan.se/ipmon/ipmonpb => ../../ipmonpb
+	bonan.se/ipmon/wireguard => ../../wireguard
+)
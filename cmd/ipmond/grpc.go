@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"bonan.se/ipmon/ipmonpb"
+	"google.golang.org/grpc"
+	"net"
+	"sync"
+)
+
+// grpcServer streams updates to every connected subscriber, starting with
+// the most recent one
+type grpcServer struct {
+	ipmonpb.UnimplementedMonitorServer
+
+	srv *grpc.Server
+	// done is closed by Close to end the streams of all subscribers
+	done chan struct{}
+
+	mu   sync.Mutex
+	last *ipmonpb.Update
+	subs map[chan *ipmonpb.Update]struct{}
+}
+
+func newGrpcServer() *grpcServer {
+	return &grpcServer{
+		done: make(chan struct{}),
+		subs: map[chan *ipmonpb.Update]struct{}{},
+	}
+}
+
+func (s *grpcServer) Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.srv = grpc.NewServer()
+	ipmonpb.RegisterMonitorServer(s.srv, s)
+	go func() {
+		if err := s.srv.Serve(l); err != nil {
+			errLog.Printf("gRPC server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close ends the stream of every subscriber and stops the server once
+// they have returned
+func (s *grpcServer) Close() {
+	close(s.done)
+	s.srv.GracefulStop()
+}
+
+func (s *grpcServer) Publish(upd *ipmon.Update) {
+	pu := ipmonpb.FromUpdate(upd)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = pu
+	for ch := range s.subs {
+		select {
+		case ch <- pu:
+		default:
+			errLog.Printf("gRPC subscriber too slow, dropping update %d", pu.Seq)
+		}
+	}
+}
+
+func (s *grpcServer) Subscribe(_ *ipmonpb.SubscribeRequest, stream ipmonpb.Monitor_SubscribeServer) error {
+	ch := make(chan *ipmonpb.Update, 32)
+	s.mu.Lock()
+	if s.last != nil {
+		ch <- s.last
+	}
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		case pu := <-ch:
+			if err := stream.Send(pu); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// healthServer answers /healthz while the monitor loop is running and
+// /readyz once the first update was seen, optionally only while there is
+// a default route
+type healthServer struct {
+	requireOnline bool
+
+	alive  atomic.Bool
+	ready  atomic.Bool
+	online atomic.Bool
+}
+
+func (s *healthServer) Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.respond(w, s.alive.Load(), "monitor not running")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !s.ready.Load():
+			s.respond(w, false, "no snapshot yet")
+		case s.requireOnline && !s.online.Load():
+			s.respond(w, false, "no default route")
+		default:
+			s.respond(w, s.alive.Load(), "monitor not running")
+		}
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			errLog.Printf("Health server: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *healthServer) respond(w http.ResponseWriter, ok bool, reason string) {
+	if !ok {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// Publish records the state of upd
+func (s *healthServer) Publish(upd *ipmon.Update) {
+	s.ready.Store(true)
+	s.online.Store(upd.Online)
+}
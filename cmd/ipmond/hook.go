@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// hookConfig holds the flags that control how hooks run, it is set up
+// before monitoring starts and not modified while hooks run
+type hookConfig struct {
+	// pretty indents JSON passed to hooks on stdin or in files, JSON
+	// passed in the environment is always compact
+	pretty bool
+	// user runs hooks as another user, nil runs them with the
+	// credentials of the daemon
+	user *hookUser
+	// passthrough lists the daemon environment variables passed on to
+	// hooks, nil passes all of them
+	passthrough map[string]bool
+}
+
+// newJSONEncoder returns an encoder for JSON passed to hooks
+func (c *hookConfig) newJSONEncoder(w io.Writer) *json.Encoder {
+	je := json.NewEncoder(w)
+	if c.pretty {
+		je.SetIndent("", "  ")
+	}
+	return je
+}
+
+type hook struct {
+	name string
+	args []string
+}
+
+// hooksFromDir returns every executable regular file in dir in lexical order
+func hooksFromDir(dir string) ([]hook, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []hook
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		hooks = append(hooks, hook{name: filepath.Join(dir, e.Name())})
+	}
+	return hooks, nil
+}
+
+// hookEnv returns the daemon environment that is passed on to hooks, with
+// the identity of the hook user when cfg drops privileges
+func hookEnv(cfg *hookConfig) (env []string) {
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		switch name {
+		case "NOTIFY_SOCKET":
+			continue
+		case "HOME", "USER", "LOGNAME":
+			if cfg.user != nil {
+				continue
+			}
+		}
+		if cfg.passthrough != nil && !cfg.passthrough[name] {
+			continue
+		}
+		env = append(env, v)
+	}
+	if u := cfg.user; u != nil {
+		env = append(env, "HOME="+u.home, "USER="+u.name, "LOGNAME="+u.name)
+	}
+	return env
+}
+
+// runHook executes h with env and optionally upd as JSON on stdin, it
+// returns the exit status of the command
+func runHook(ctx context.Context, cfg *hookConfig, h hook, upd *ipmon.Update, env []string, sendJSON bool) (int, error) {
+	cmd := exec.CommandContext(ctx, h.name, h.args...)
+
+	pr, pw := io.Pipe()
+
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = pr
+	cmd.Stdout = os.Stdout
+	cmd.Env = env
+	if cfg.user != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cfg.user.cred}
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+
+	if sendJSON {
+		je := cfg.newJSONEncoder(pw)
+		if err := je.Encode(upd); err != nil {
+			errLog.Printf("Unable to encode JSON: %v", err)
+		}
+	}
+	_ = pw.Close()
+	err := cmd.Wait()
+	return cmd.ProcessState.ExitCode(), err
+}
+
+// writeJSONFile writes upd to a new temporary file and returns its name,
+// the caller is responsible for removing it
+func writeJSONFile(cfg *hookConfig, upd *ipmon.Update) (string, error) {
+	f, err := os.CreateTemp("", "ipmon-*.json")
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.newJSONEncoder(f).Encode(upd); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	// the file is only readable by its owner
+	if cfg.user != nil {
+		if err := f.Chown(int(cfg.user.cred.Uid), int(cfg.user.cred.Gid)); err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// readUpdate reads an update in the JSON format passed to hooks
+func readUpdate(path string) (*ipmon.Update, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var upd ipmon.Update
+	if err := json.Unmarshal(b, &upd); err != nil {
+		return nil, err
+	}
+	return &upd, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLogWriter turns every message of a log.Logger into a JSON object on
+// a line of its own. The loggers share mu so that lines do not interleave.
+type jsonLogWriter struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level string
+}
+
+type jsonLogLine struct {
+	Time  string `json:"ts"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(jsonLogLine{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: j.level,
+		Msg:   strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setLogFormat switches the daemon logs to format, text or json. Debug
+// logs are only switched when enabled.
+func setLogFormat(format string, debug bool) error {
+	switch format {
+	case "text":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	mu := &sync.Mutex{}
+	errLog.SetPrefix("")
+	errLog.SetOutput(jsonLogWriter{mu: mu, w: os.Stderr, level: "error"})
+	infoLog.SetPrefix("")
+	infoLog.SetOutput(jsonLogWriter{mu: mu, w: os.Stderr, level: "info"})
+	if debug {
+		dbgLog.SetPrefix("")
+		dbgLog.SetOutput(jsonLogWriter{mu: mu, w: os.Stderr, level: "debug"})
+		ipmon.Debug.SetPrefix("")
+		ipmon.Debug.SetOutput(jsonLogWriter{mu: mu, w: os.Stderr, level: "debug"})
+	}
+	return nil
+}
@@ -2,16 +2,21 @@ package main
 
 import (
 	"bonan.se/ipmon"
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/vishvananda/netlink"
 	"io"
 	"log"
 	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
@@ -23,18 +28,98 @@ var (
 
 func main() {
 	flgDebug := flag.Bool("d", false, "Enable debug logging")
+	flgLogFormat := flag.String("log-format", "text", "Format of the daemon logs, text or json")
 	flgJson := flag.Bool("j", false, "Send JSON to process stdin")
+	flgJsonEnv := flag.Bool("json-env", false, "Pass JSON to process in IPMON_JSON")
+	flgJsonFile := flag.Bool("json-file", false, "Write JSON to a temporary file and pass its name in IPMON_JSON_FILE")
 	flgInterval := flag.Int("i", 0, "Trigger periodic updates (seconds)")
+	flgHooksDir := flag.String("hooks-dir", "", "Execute every executable file in directory on each update")
+	flgDryRun := flag.Bool("dry-run", false, "Log the command and environment instead of executing")
+	flgNoInit := flag.Bool("no-init", false, "Do not execute on startup, only on changes")
+	flgEnvFile := flag.String("env-file", "", "Atomically write the environment of every update to file, for use with EnvironmentFile=")
+	flgState := flag.String("state", "", "Persist state to file and skip the initial execution if nothing changed since last run")
+	flgLifetime := flag.Duration("lifetime-warning", 0, "Trigger an update this long before an address valid lifetime expires")
+	flgStats := flag.Bool("stats", false, "Include interface counters in the JSON of periodic updates")
+	flgNoLinkLocal := flag.Bool("no-link-local", false, "Ignore link-local addresses")
+	flgRefresh := flag.Duration("refresh-window", 0, "Collapse an address removed and added again within this window into a refresh")
+	flgNetns := flag.String("netns", "", "Monitor the network namespace at path")
+	flgGrpc := flag.String("grpc", "", "Stream updates over gRPC on address")
+	flgStreamFD := flag.Int("stream-fd", -1, "Write updates as newline-delimited JSON to file descriptor, e.g. 1 for stdout or 3")
+	flag.BoolVar(&streamPatch, "stream-patch", false, "Send JSON Patch documents against the previous update on -sock and -stream-fd after the first update")
+	flgSock := flag.String("sock", "", "Stream updates as newline-delimited JSON to clients of the unix socket at path")
+	flgScopes := flag.String("scopes", "", "Only include addresses with these comma separated scopes (universe, site, link, host)")
+	flgRules := flag.Bool("rules", false, "Watch policy routing rules")
+	flgPassthrough := flag.String("env-passthrough", "", "Comma separated daemon environment variables passed to hooks, all when empty")
+	flgDropPriv := flag.String("drop-priv-for-hook", "", "Run hooks as user[:group] instead of the daemon user")
+	flgJsonPretty := flag.Bool("json-pretty", false, "Indent JSON passed on stdin or in files")
+	flgSlim := flag.Bool("slim-events", false, "Only include the full state in init and interval updates")
+	var flgWatchDst stringList
+	flag.Var(&flgWatchDst, "watch-dst", "Only trigger on routes within prefix and default routes, can be repeated")
+	var flgWatchRoute stringList
+	flag.Var(&flgWatchRoute, "watch-route", "Only run hooks when a route to exactly this prefix is added or removed, can be repeated")
+	flgSettle := flag.Duration("startup-settle", 0, "Coalesce all changes for this long after startup, or until online, into one init update")
+	flgFlapThreshold := flag.Int("flap-threshold", 0, "Stop running hooks when more changes than this arrive within -flap-window")
+	flgFlapWindow := flag.Duration("flap-window", 10*time.Second, "Window for -flap-threshold")
+	flgMinInterval := flag.Duration("min-interval", 0, "Minimum time between two executions, changes in between are coalesced")
+	flgRetainStale := flag.Bool("retain-stale", false, "Keep addresses of interfaces that went down as stale")
+	flgStall := flag.Duration("stall-timeout", 0, "Force a full resync when no event or interval tick was seen for this long")
+	flgHost := flag.Bool("include-host", false, "Include the hostname and boot id in updates")
+	flgRaw := flag.Bool("raw", false, "Include the netlink message type and flags of events in JSON")
+	flgSignal := flag.String("signal", "", "Send signal to a process on each update instead of executing a command")
+	flgPidFile := flag.String("pid-file", "", "Read the pid to signal from file")
+	flgPidOf := flag.String("pid-of", "", "Signal all processes with this name")
+	flgIntervalStream := flag.Bool("interval-stream-only", false, "Publish periodic updates to streams and health checks without running hooks")
+	flgJitter := flag.Duration("interval-jitter", 0, "Randomize each periodic update by up to plus or minus this duration")
+	flgEnvMinimal := flag.Bool("env-minimal", false, "Only pass the update type, online state and default route variables")
+	flgRouteProtos := flag.String("route-protocols", "", "Only include routes of these comma separated protocols (static, dhcp, ra, kernel, bgp, ...)")
+	flgExcludeProtos := flag.String("exclude-route-protocols", "", "Ignore routes of these comma separated protocols")
+	flgBackoffAfter := flag.Int("hook-backoff-after", 3, "Back off a hook after this many consecutive failures, 0 disables")
+	flgBackoffMax := flag.Duration("hook-backoff-max", 5*time.Minute, "Maximum time a failing hook is delayed")
+	flgEnvListSep := flag.String("env-list-sep", " ", "Separator for list values such as IPMON_CHANGE and IPMON_IFACES")
+	flgHealth := flag.String("health", "", "Serve /healthz and /readyz over HTTP on address")
+	flgHealthOnline := flag.Bool("health-online", false, "Only report ready while a default route exists")
+	flgWorkers := flag.Int("workers", 0, "Execute hooks for updates after the first one asynchronously in this many workers")
+	flgWaitOnline := flag.Bool("wait-online", false, "Wait until the host is online and exit without running hooks")
+	flgWaitTimeout := flag.Duration("wait-timeout", 0, "Exit with an error if not online within this duration")
+	flgWaitFamily := flag.String("wait-family", "v4", "Address family required by -wait-online: v4, v6, either or both")
+	flgWatch := flag.String("watch", "addr,route,link", "Comma separated netlink subscriptions: addr, route, link, neigh")
+	flgInject := flag.String("inject", "", "Run the hooks once for the JSON update in file and exit")
+	flgRecvBuf := flag.Int("recv-buffer", 0, "Netlink receive buffer size in bytes")
+	flgForceRecvBuf := flag.Bool("force-recv-buffer", false, "Exceed net.core.rmem_max for -recv-buffer, requires CAP_NET_ADMIN")
+	flgOnlyPrimary := flag.Bool("only-primary-change", false, "Only execute when the default route source address changes")
+	var flgIface stringList
+	flag.Var(&flgIface, "iface", "Only watch this interface and pass terse variables for it, can be repeated")
+	flgChanBuf := flag.Int("channel-buffer", 1, "Number of netlink events buffered per subscription while hooks run")
+	flgRequireGw := flag.Bool("require-gateway", false, "Only trigger on default routes and routes with a gateway")
+	flgAnycast := flag.Bool("anycast", false, "Include IPv6 anycast addresses in snapshots")
+	flgMulticast := flag.Bool("multicast", false, "Include joined multicast groups in snapshots")
+	flgConfig := flag.String("config", "", "Read configuration from file, flags override file values")
 
 	flag.Parse()
 	Status("Starting")
 
-	if os.Getenv("DEBUG") == "1" || *flgDebug {
+	argv := flag.Args()
+
+	if *flgConfig != "" {
+		command, err := loadConfig(flag.CommandLine, *flgConfig)
+		if err != nil {
+			errLog.Printf("Unable to load config: %v", err)
+			os.Exit(1)
+		}
+		if len(argv) == 0 {
+			argv = command
+		}
+	}
+
+	debug := os.Getenv("DEBUG") == "1" || *flgDebug
+	if debug {
 		dbgLog.SetOutput(os.Stderr)
 		ipmon.Debug.SetOutput(os.Stderr)
 	}
-
-	argv := flag.Args()
+	if err := setLogFormat(*flgLogFormat, debug); err != nil {
+		errLog.Print(err)
+		os.Exit(1)
+	}
 
 	cmdName := ""
 	var args []string
@@ -44,55 +129,421 @@ func main() {
 		args = argv[1:]
 	}
 
+	hookCfg := &hookConfig{pretty: *flgJsonPretty}
+
+	if *flgPassthrough != "" {
+		hookCfg.passthrough = map[string]bool{}
+		for _, name := range strings.Split(*flgPassthrough, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hookCfg.passthrough[name] = true
+			}
+		}
+	}
+
+	if *flgDropPriv != "" {
+		u, err := parseHookUser(*flgDropPriv)
+		if err != nil {
+			errLog.Printf("Invalid -drop-priv-for-hook: %v", err)
+			os.Exit(1)
+		}
+		hookCfg.user = u
+	}
+
+	var sigTarget *signalTarget
+	if *flgSignal != "" {
+		sig, err := parseSignal(*flgSignal)
+		if err != nil {
+			errLog.Print(err)
+			os.Exit(1)
+		}
+		if (*flgPidFile == "") == (*flgPidOf == "") {
+			errLog.Print("-signal requires exactly one of -pid-file and -pid-of")
+			os.Exit(1)
+		}
+		sigTarget = &signalTarget{sig: sig, pidFile: *flgPidFile, pidOf: *flgPidOf}
+	}
+
+	backoff := newHookBackoff(*flgBackoffAfter, *flgBackoffMax)
+
+	lastFingerprint := ""
+	if *flgState != "" {
+		fp, err := readState(*flgState)
+		if err != nil {
+			errLog.Printf("Unable to read state: %v", err)
+		}
+		lastFingerprint = fp
+	}
+
+	var grpcSrv *grpcServer
+	if *flgGrpc != "" {
+		grpcSrv = newGrpcServer()
+		if err := grpcSrv.Serve(*flgGrpc); err != nil {
+			errLog.Printf("Unable to start gRPC server: %v", err)
+			os.Exit(1)
+		}
+		defer grpcSrv.Close()
+	}
+
+	var fdStrm *fdStream
+	if *flgStreamFD >= 0 {
+		s, err := newFDStream(*flgStreamFD)
+		if err != nil {
+			errLog.Printf("Invalid -stream-fd: %v", err)
+			os.Exit(1)
+		}
+		fdStrm = s
+	}
+
+	var sockSrv *sockServer
+	if *flgSock != "" {
+		sockSrv = newSockServer()
+		if err := sockSrv.Serve(*flgSock); err != nil {
+			errLog.Printf("Unable to listen on socket: %v", err)
+			os.Exit(1)
+		}
+		defer sockSrv.Close()
+	}
+
+	var health *healthServer
+	if *flgHealth != "" {
+		health = &healthServer{requireOnline: *flgHealthOnline}
+		if err := health.Serve(*flgHealth); err != nil {
+			errLog.Printf("Unable to start health server: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	rdy := false
 
-	ctx := context.Background()
-	if err := ipmon.Monitor(ctx, *flgInterval, func(upd *ipmon.Update) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-		if !rdy {
+	opts := ipmon.DefaultMonitorOptions()
+	opts.Interval = time.Duration(*flgInterval) * time.Second
+	opts.SkipInitial = *flgNoInit
+	opts.LifetimeWarning = *flgLifetime
+	opts.IncludeStats = *flgStats
+	opts.IncludeLinkLocal = !*flgNoLinkLocal
+	opts.RefreshWindow = *flgRefresh
+	opts.Netns = *flgNetns
+	opts.WatchRules = *flgRules
+	opts.FullSnapshotOnEvent = !*flgSlim
+	opts.WireGuardInfo = wireguardInfo
+	opts.MinInterval = *flgMinInterval
+	opts.StartupSettle = *flgSettle
+	opts.FlapThreshold = *flgFlapThreshold
+	opts.FlapWindow = *flgFlapWindow
+	opts.RetainStaleAddrs = *flgRetainStale
+	opts.StallTimeout = *flgStall
+	opts.IncludeRaw = *flgRaw
+	opts.IncludeHost = *flgHost
+	opts.IntervalJitter = *flgJitter
+	opts.RecvBufferSize = *flgRecvBuf
+	opts.ForceRecvBuffer = *flgForceRecvBuf
+	opts.OnlyPrimaryChange = *flgOnlyPrimary
+	opts.Interfaces = flgIface
+	opts.ChannelBuffer = *flgChanBuf
+	opts.RequireGateway = *flgRequireGw
+	opts.IncludeAnycast = *flgAnycast
+	opts.IncludeMulticast = *flgMulticast
+	opts.Logf = infoLog.Printf
+	opts.Started = func() {
+		if health != nil {
+			health.alive.Store(true)
+		}
+		// without the init update there is nothing to wait for
+		if *flgNoInit {
 			Status("Running")
 			Ready()
 			rdy = true
+			if health != nil {
+				health.ready.Store(true)
+			}
+		}
+	}
+	for _, dst := range flgWatchDst {
+		_, n, err := net.ParseCIDR(dst)
+		if err != nil {
+			errLog.Print(err)
+			os.Exit(1)
+		}
+		opts.WatchDestinations = append(opts.WatchDestinations, *n)
+	}
+	for _, dst := range flgWatchRoute {
+		_, n, err := net.ParseCIDR(dst)
+		if err != nil {
+			errLog.Print(err)
+			os.Exit(1)
+		}
+		opts.WatchRoutes = append(opts.WatchRoutes, *n)
+	}
+	for _, p := range []struct {
+		names string
+		dst   *[]netlink.RouteProtocol
+	}{
+		{*flgRouteProtos, &opts.RouteProtocols},
+		{*flgExcludeProtos, &opts.ExcludeRouteProtocols},
+	} {
+		if p.names == "" {
+			continue
+		}
+		for _, name := range strings.Split(p.names, ",") {
+			proto, err := ipmon.ParseRouteProtocol(strings.TrimSpace(name))
+			if err != nil {
+				errLog.Print(err)
+				os.Exit(1)
+			}
+			*p.dst = append(*p.dst, proto)
+		}
+	}
+	opts.WatchAddr, opts.WatchRoute, opts.WatchLink = false, false, false
+	for _, name := range strings.Split(*flgWatch, ",") {
+		switch strings.TrimSpace(name) {
+		case "addr":
+			opts.WatchAddr = true
+		case "route":
+			opts.WatchRoute = true
+		case "link":
+			opts.WatchLink = true
+		case "neigh":
+			opts.WatchNeigh = true
+		case "":
+		default:
+			errLog.Printf("Unknown subscription %q", name)
+			os.Exit(1)
+		}
+	}
+	if !opts.WatchAddr && !opts.WatchRoute && !opts.WatchLink && !opts.WatchNeigh && !opts.WatchRules {
+		errLog.Print("No subscription in -watch and -rules not set")
+		os.Exit(1)
+	}
+	if *flgScopes != "" {
+		for _, name := range strings.Split(*flgScopes, ",") {
+			scope, err := ipmon.ParseScope(strings.TrimSpace(name))
+			if err != nil {
+				errLog.Print(err)
+				os.Exit(1)
+			}
+			opts.Scopes = append(opts.Scopes, scope)
 		}
+	}
 
-		infoLog.Printf("Update: %s %v %+v Link[%s] GW[%s] Source[%s]", upd.Type, upd.Change, upd.Address, upd.Link, upd.Gateway, upd.Source)
+	if *flgWaitOnline {
+		online, err := onlineCondition(*flgWaitFamily)
+		if err != nil {
+			errLog.Print(err)
+			os.Exit(2)
+		}
+		if err := waitOnline(ctx, opts, online, *flgWaitTimeout); err != nil {
+			errLog.Print(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-		if cmdName != "" {
-			newEnv := upd.MarshalEnv()
-			cmd := exec.CommandContext(ctx, cmdName, args...)
-
-			pr, pw := io.Pipe()
-
-			cmd.Stderr = os.Stderr
-			cmd.Stdin = pr
-			cmd.Stdout = os.Stdout
-			cmd.Env = []string{}
-			for _, v := range os.Environ() {
-				if strings.HasPrefix(v, "NOTIFY_SOCKET=") {
-					continue
+	var runHooks func(ctx context.Context, upd *ipmon.Update, hooks []hook)
+
+	// execute signals the target process and runs the hooks for upd
+	execute := func(ctx context.Context, upd *ipmon.Update) {
+		if sigTarget != nil {
+			if *flgDryRun {
+				if pids, err := sigTarget.pids(); err == nil {
+					infoLog.Printf("Dry run: signal %s to %v", sigTarget.sig, pids)
 				}
-				cmd.Env = append(cmd.Env, v)
+			} else if pids, err := sigTarget.signal(); err != nil {
+				errLog.Printf("Unable to send %s: %v", sigTarget.sig, err)
+			} else {
+				infoLog.Printf("Sent %s to %v", sigTarget.sig, pids)
 			}
-			cmd.Env = append(cmd.Env, newEnv...)
-			if err := cmd.Start(); err != nil {
-				errLog.Print(err)
+		}
+
+		var hooks []hook
+		if cmdName != "" {
+			hooks = append(hooks, hook{name: cmdName, args: args})
+		}
+		if *flgHooksDir != "" {
+			dirHooks, err := hooksFromDir(*flgHooksDir)
+			if err != nil {
+				errLog.Printf("Unable to read hooks directory: %v", err)
 			}
+			hooks = append(hooks, dirHooks...)
+		}
+		if len(hooks) == 0 && !*flgDryRun {
+			return
+		}
+		runHooks(ctx, upd, hooks)
+	}
 
+	// runHooks runs hooks for upd, a hook that is backed off runs for the
+	// latest update it missed once the backoff expires
+	runHooks = func(ctx context.Context, upd *ipmon.Update, hooks []hook) {
+		var env []string
+		if len(flgIface) > 0 {
+			env = upd.MarshalEnvInterface(flgIface...)
+		} else if *flgEnvMinimal {
+			env = upd.MarshalEnvMinimal()
+		} else {
+			env = upd.MarshalEnvSep(*flgEnvListSep)
+		}
+		if *flgJsonEnv {
+			if b, err := json.Marshal(upd); err != nil {
+				errLog.Printf("Unable to encode JSON: %v", err)
+			} else {
+				env = append(env, fmt.Sprintf("IPMON_JSON=%s", b))
+			}
+		}
+		if *flgDryRun {
+			for _, h := range hooks {
+				infoLog.Printf("Dry run: %s", strings.Join(append([]string{h.name}, h.args...), " "))
+			}
+			for _, v := range env {
+				infoLog.Printf("Dry run: env %s", v)
+			}
 			if *flgJson {
-				je := json.NewEncoder(pw)
-				if err := je.Encode(upd); err != nil {
-					errLog.Printf("Unable to encode JSON: %v", err)
+				var b bytes.Buffer
+				if err := hookCfg.newJSONEncoder(&b).Encode(upd); err == nil {
+					infoLog.Printf("Dry run: stdin %s", bytes.TrimSuffix(b.Bytes(), []byte("\n")))
 				}
 			}
-			_ = pw.Close()
-			if err := cmd.Wait(); err != nil {
-				errLog.Print(err)
+			return
+		}
+		if *flgJsonFile {
+			if name, err := writeJSONFile(hookCfg, upd); err != nil {
+				errLog.Printf("Unable to write JSON file: %v", err)
+			} else {
+				defer os.Remove(name)
+				env = append(env, fmt.Sprintf("IPMON_JSON_FILE=%s", name))
+			}
+		}
+		env = append(hookEnv(hookCfg), env...)
+		for _, h := range hooks {
+			if d := backoff.wait(h.name); d > 0 {
+				infoLog.Printf("Hook %s is backed off for %s, delaying", h.name, d.Round(time.Second))
+				h := h
+				backoff.delay(h.name, func() {
+					if ctx.Err() == nil {
+						runHooks(ctx, upd, []hook{h})
+					}
+				})
+				continue
+			}
+			status, err := runHook(ctx, hookCfg, h, upd, env, *flgJson)
+			if err != nil {
+				errLog.Printf("Hook %s exited with status %d: %v", h.name, status, err)
+			} else {
+				infoLog.Printf("Hook %s exited with status %d", h.name, status)
+			}
+			if d := backoff.done(h.name, err == nil); d > 0 {
+				errLog.Printf("Hook %s keeps failing, backing off for %s", h.name, d)
+			}
+		}
+	}
+
+	if *flgInject != "" {
+		upd, err := readUpdate(*flgInject)
+		if err != nil {
+			errLog.Printf("Unable to read update: %v", err)
+			os.Exit(1)
+		}
+		infoLog.Printf("Injected update: %s", upd)
+		execute(ctx, upd)
+		return
+	}
+
+	// with workers the first update is still executed synchronously so
+	// that READY is only sent once its hooks have completed
+	var jobs chan *ipmon.Update
+	var wg sync.WaitGroup
+	for i := 0; i < *flgWorkers; i++ {
+		if jobs == nil {
+			jobs = make(chan *ipmon.Update, 64)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for upd := range jobs {
+				execute(ctx, upd)
+			}
+		}()
+	}
+
+	if err := ipmon.MonitorContext(ctx, opts, func(ctx context.Context, upd *ipmon.Update) error {
+		async := rdy && jobs != nil
+		if !rdy {
+			markReady := func() {
+				Status("Running")
+				Ready()
+				rdy = true
+			}
+			if jobs != nil {
+				defer markReady()
+			} else {
+				markReady()
+			}
+		}
+
+		infoLog.Printf("Update: %s", upd)
+
+		if grpcSrv != nil {
+			grpcSrv.Publish(upd)
+		}
+		if sockSrv != nil {
+			sockSrv.Publish(upd)
+		}
+		if fdStrm != nil {
+			fdStrm.Publish(upd)
+		}
+		if health != nil {
+			health.Publish(upd)
+		}
+		if *flgEnvFile != "" {
+			if err := writeEnvFile(*flgEnvFile, upd, *flgEnvListSep); err != nil {
+				errLog.Printf("Unable to write environment file: %v", err)
+			}
+		}
+		if upd.Type == "interval" && *flgIntervalStream {
+			return nil
+		}
+		if len(opts.WatchRoutes) > 0 && upd.WatchedRoute == "" {
+			return nil
+		}
+
+		if *flgState != "" {
+			fp := upd.Fingerprint()
+			if upd.Type == "init" && fp == lastFingerprint {
+				infoLog.Printf("State unchanged since last run, skipping execution")
+				return nil
+			}
+			if fp != lastFingerprint {
+				defer func() {
+					if err := writeState(*flgState, fp); err != nil {
+						errLog.Printf("Unable to write state: %v", err)
+					}
+				}()
+				lastFingerprint = fp
 			}
 		}
 
+		if async {
+			select {
+			case jobs <- upd:
+			case <-ctx.Done():
+			}
+			return nil
+		}
+		execute(ctx, upd)
+		return nil
 	}); err != nil {
 		errLog.Printf("Error while monitoring: %v", err)
 	}
+	if jobs != nil {
+		close(jobs)
+		wg.Wait()
+	}
+	if health != nil {
+		health.alive.Store(false)
+	}
+	Stopping()
 }
 
 func notifyOpen() bool {
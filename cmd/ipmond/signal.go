@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalTarget sends a signal to a running process instead of executing a
+// hook, the process is looked up on every update since it may restart
+type signalTarget struct {
+	sig     syscall.Signal
+	pidFile string
+	pidOf   string
+}
+
+// parseSignal accepts a signal name with or without the SIG prefix, or a
+// signal number
+func parseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// pids returns the processes to signal
+func (t *signalTarget) pids() ([]int, error) {
+	if t.pidFile != "" {
+		b, err := os.ReadFile(t.pidFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("%s: invalid pid", t.pidFile)
+		}
+		return []int{pid}, nil
+	}
+	return pidOf(t.pidOf)
+}
+
+// signal sends the signal to every matching process and returns the pids
+// that were signaled
+func (t *signalTarget) signal() ([]int, error) {
+	pids, err := t.pids()
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %s", t.pidOf)
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, t.sig); err != nil {
+			return nil, fmt.Errorf("pid %d: %w", pid, err)
+		}
+	}
+	return pids, nil
+}
+
+// commLen is the length the kernel truncates command names in
+// /proc/<pid>/comm to
+const commLen = 15
+
+// pidOf returns the pids of all processes whose command name is name.
+// Names longer than comm holds are compared against the executable of the
+// process instead.
+func pidOf(name string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		if procNamed(filepath.Join("/proc", e.Name()), name) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// procNamed reports whether the process at dir in /proc is named name
+func procNamed(dir, name string) bool {
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return false
+	}
+	if len(name) <= commLen {
+		return strings.TrimSpace(string(comm)) == name
+	}
+	if strings.TrimSpace(string(comm)) != name[:commLen] {
+		return false
+	}
+	// the first argument is readable for processes of other users, the
+	// exe link is not without privileges
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		arg0, _, _ := strings.Cut(string(cmdline), "\x00")
+		if filepath.Base(arg0) == name {
+			return true
+		}
+	}
+	exe, err := os.Readlink(filepath.Join(dir, "exe"))
+	return err == nil && filepath.Base(exe) == name
+}
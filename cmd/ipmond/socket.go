@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// sockServer streams updates as newline-delimited JSON to every client
+// connected to a unix socket, starting with the most recent one
+type sockServer struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	last []byte
+	// prev is the update last is encoded from, the base of the next patch
+	prev *ipmon.Update
+	subs map[chan []byte]struct{}
+}
+
+func newSockServer() *sockServer {
+	return &sockServer{
+		subs: map[chan []byte]struct{}{},
+	}
+}
+
+func (s *sockServer) Serve(path string) error {
+	// a socket left behind by a previous run would make Listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				errLog.Printf("Socket: %v", err)
+				continue
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting clients and removes the socket
+func (s *sockServer) Close() error {
+	return s.l.Close()
+}
+
+func (s *sockServer) Publish(upd *ipmon.Update) {
+	b, err := json.Marshal(upd)
+	if err != nil {
+		errLog.Printf("Unable to encode JSON: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// clients start from last, so patches must be against the update last
+	// holds
+	msg := b
+	if streamPatch && s.prev != nil {
+		ops, err := ipmon.JSONPatch(s.prev, upd)
+		if err != nil {
+			errLog.Printf("Unable to create patch: %v", err)
+			return
+		}
+		if msg, err = json.Marshal(ops); err != nil {
+			errLog.Printf("Unable to encode JSON: %v", err)
+			return
+		}
+		msg = append(msg, '\n')
+	}
+	s.last = b
+	s.prev = upd
+	for ch := range s.subs {
+		select {
+		case ch <- msg:
+		default:
+			if streamPatch {
+				// a missed patch leaves the client with the wrong state
+				errLog.Printf("Socket client too slow, disconnecting")
+				delete(s.subs, ch)
+				close(ch)
+				continue
+			}
+			errLog.Printf("Socket client too slow, dropping update %d", upd.Seq)
+		}
+	}
+}
+
+func (s *sockServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	ch := make(chan []byte, 32)
+	s.mu.Lock()
+	if s.last != nil {
+		ch <- s.last
+	}
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+		s.mu.Unlock()
+	}()
+
+	// clients do not send anything, reading notices when they hang up
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case b, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}
+}
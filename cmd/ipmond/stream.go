@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// streamPatch makes the socket and file descriptor streams send JSON Patch
+// documents against the previous update after the first full update
+var streamPatch bool
+
+// fdStream writes updates as newline-delimited JSON to an inherited file
+// descriptor, e.g. one set up by a supervisor
+type fdStream struct {
+	f *os.File
+	// enc is never indented, -json-pretty only applies to hooks
+	enc  *json.Encoder
+	prev *ipmon.Update
+}
+
+func newFDStream(fd int) (*fdStream, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	return &fdStream{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *fdStream) Publish(upd *ipmon.Update) {
+	var v any = upd
+	if streamPatch && s.prev != nil {
+		ops, err := ipmon.JSONPatch(s.prev, upd)
+		if err != nil {
+			errLog.Printf("Unable to create patch: %v", err)
+			return
+		}
+		v = ops
+	}
+	s.prev = upd
+	if err := s.enc.Encode(v); err != nil {
+		errLog.Printf("Unable to write update to %s: %v", s.f.Name(), err)
+	}
+}
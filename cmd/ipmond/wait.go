@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bonan.se/ipmon"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errOnline = errors.New("online")
+
+// onlineCondition reports whether upd satisfies family, which is one of
+// v4, v6, either or both. A family is online when it has a default route
+// and a source address derived the same way as IPMON_IPV4 and IPMON_IPV6.
+func onlineCondition(family string) (func(*ipmon.Update) bool, error) {
+	has := func(u *ipmon.Update, key string) bool {
+		return u.MarshalEnvMap()[key] != ""
+	}
+	switch family {
+	case "v4":
+		return func(u *ipmon.Update) bool { return has(u, "IPMON_IPV4") }, nil
+	case "v6":
+		return func(u *ipmon.Update) bool { return has(u, "IPMON_IPV6") }, nil
+	case "either":
+		return func(u *ipmon.Update) bool { return has(u, "IPMON_IPV4") || has(u, "IPMON_IPV6") }, nil
+	case "both":
+		return func(u *ipmon.Update) bool { return has(u, "IPMON_IPV4") && has(u, "IPMON_IPV6") }, nil
+	}
+	return nil, fmt.Errorf("unknown family %q, expected v4, v6, either or both", family)
+}
+
+// waitOnline blocks until online reports true for an update or timeout
+// expires, a zero timeout waits forever
+func waitOnline(ctx context.Context, opts ipmon.MonitorOptions, online func(*ipmon.Update) bool, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	opts.SkipInitial = false
+	opts.MinInterval = 0
+	opts.Started = nil
+	err := ipmon.MonitorContext(ctx, opts, func(_ context.Context, upd *ipmon.Update) error {
+		dbgLog.Printf("Update: %s", upd)
+		if online(upd) {
+			infoLog.Printf("Online: %s", upd)
+			return errOnline
+		}
+		return nil
+	})
+	if errors.Is(err, errOnline) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("not online after %s", timeout)
+	}
+	return errors.New("monitoring stopped")
+}
@@ -0,0 +1,10 @@
+//go:build wgctrl
+
+package main
+
+import (
+	"bonan.se/ipmon/wireguard"
+)
+
+// wireguardInfo is set as MonitorOptions.WireGuardInfo
+var wireguardInfo = wireguard.Info
@@ -0,0 +1,11 @@
+//go:build !wgctrl
+
+package main
+
+import (
+	"bonan.se/ipmon"
+)
+
+// wireguardInfo is set as MonitorOptions.WireGuardInfo, without the wgctrl
+// tag wireguard links are reported without device info
+var wireguardInfo func(name string) (*ipmon.WireGuard, error)
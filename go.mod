@@ -3,8 +3,7 @@ module bonan.se/ipmon
 go 1.20
 
 require (
-	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netlink v1.3.0
+	github.com/vishvananda/netns v0.0.4
 	golang.org/x/sys v0.13.0
 )
-
-require github.com/vishvananda/netns v0.0.4 // indirect
@@ -0,0 +1,118 @@
+package ipmon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/cpu"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Address kinds besides unicast, see Address.Kind
+const (
+	AddrAnycast   = "anycast"
+	AddrMulticast = "multicast"
+)
+
+// procAddrs reads an address list in the format of /proc/net/anycast6 and
+// /proc/net/igmp6, an interface index, name and hex encoded IPv6 address
+// per line, and returns the addresses by interface index
+func procAddrs(name string, into map[int][]net.IP) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		idx, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv6len {
+			continue
+		}
+		into[idx] = append(into[idx], net.IP(b))
+	}
+}
+
+// procIGMP reads the IPv4 multicast groups from /proc/net/igmp, where the
+// interface lines are followed by tab indented lines with the groups in
+// host byte order
+func procIGMP(name string, into map[int][]net.IP) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	idx := -1
+	for sc.Scan() {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") {
+			if i, err := strconv.Atoi(fields[0]); err == nil {
+				idx = i
+			} else {
+				idx = -1
+			}
+			continue
+		}
+		b, err := hex.DecodeString(fields[0])
+		if idx < 0 || err != nil || len(b) != net.IPv4len {
+			continue
+		}
+		if !cpu.IsBigEndian {
+			b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+		}
+		into[idx] = append(into[idx], net.IP(b))
+	}
+}
+
+// groupAddrs returns the anycast and multicast addresses of the current
+// network namespace by interface index, as enabled by IncludeAnycast and
+// IncludeMulticast
+func (m *monitor) groupAddrs() map[int][]*Address {
+	res := map[int][]*Address{}
+	add := func(ips map[int][]net.IP, kind string) {
+		for idx, list := range ips {
+			for _, ip := range list {
+				cidr := 128
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, cidr = ip4, 32
+				}
+				res[idx] = append(res[idx], &Address{
+					Address: ip.String(),
+					CIDR:    cidr,
+					Kind:    kind,
+					N: netlink.Addr{
+						IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(cidr, cidr)},
+					},
+				})
+			}
+		}
+	}
+	if m.opts.IncludeAnycast {
+		ips := map[int][]net.IP{}
+		procAddrs("/proc/net/anycast6", ips)
+		add(ips, AddrAnycast)
+	}
+	if m.opts.IncludeMulticast {
+		ips := map[int][]net.IP{}
+		procIGMP("/proc/net/igmp", ips)
+		procAddrs("/proc/net/igmp6", ips)
+		add(ips, AddrMulticast)
+	}
+	return res
+}
@@ -0,0 +1,22 @@
+package ipmon
+
+import (
+	"os"
+	"strings"
+)
+
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// hostInfo returns the hostname and the kernel boot id, which changes on
+// every boot. Either is empty when it cannot be read.
+func (m *monitor) hostInfo() (string, string) {
+	host, err := os.Hostname()
+	if err != nil {
+		m.logf("Hostname: %v", err)
+	}
+	b, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		m.logf("Read boot id: %v", err)
+	}
+	return host, strings.TrimSpace(string(b))
+}
@@ -0,0 +1,125 @@
+// Package ipmonpb contains the protobuf and gRPC definitions for streaming
+// ipmon updates
+package ipmonpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ipmon.proto
+
+import (
+	"bonan.se/ipmon"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromUpdate converts u to its protobuf representation
+func FromUpdate(u *ipmon.Update) *Update {
+	pu := &Update{
+		V:                 int32(u.Version),
+		Type:              u.Type,
+		Change:            u.Change,
+		Link:              u.Link,
+		LinkKind:          u.LinkKind,
+		Address:           fromAddress(u.Address),
+		OldAddress:        fromAddress(u.OldAddress),
+		Gateway:           u.Gateway,
+		Source:            u.Source,
+		Seq:               u.Seq,
+		Online:            u.Online,
+		Netns:             u.Netns,
+		Partial:           u.Partial,
+		Hostname:          u.Hostname,
+		BootId:            u.BootID,
+		Mac:               u.MAC,
+		OldMac:            u.OldMAC,
+		ChangedInterfaces: u.ChangedInterfaces,
+		RemovedInterfaces: u.RemovedInterfaces,
+		Metric:            int32(u.Metric),
+		OldMetric:         int32(u.OldMetric),
+		WatchedRoute:      u.WatchedRoute,
+		WatchedRouteState: u.WatchedRouteState,
+		DelegatedPrefixes: u.DelegatedPrefixes,
+		Interfaces:        map[string]*Interface{},
+	}
+	if !u.Timestamp.IsZero() {
+		pu.Ts = timestamppb.New(u.Timestamp)
+	}
+	if u.Raw != nil {
+		pu.Raw = &Raw{Type: u.Raw.Type, Flags: u.Raw.Flags}
+	}
+	for _, r := range u.Routes {
+		pu.Routes = append(pu.Routes, &Route{
+			Destination: r.Destination,
+			Gateway:     r.Gateway,
+			Link:        r.Link,
+			Src:         r.Src,
+			Ifindex:     int32(r.LinkIndex),
+			Table:       int32(r.Table),
+			TableName:   r.TableName,
+			Metric:      int32(r.Metric),
+		})
+	}
+	for _, r := range u.Rules {
+		pu.Rules = append(pu.Rules, &Rule{
+			Priority:  int32(r.Priority),
+			From:      r.From,
+			To:        r.To,
+			Table:     int32(r.Table),
+			Fwmark:    int32(r.Mark),
+			TableName: r.TableName,
+		})
+	}
+	for _, n := range u.Neighbors {
+		pu.Neighbors = append(pu.Neighbors, &Neighbor{
+			Ip:    n.IP,
+			Mac:   n.MAC,
+			Link:  n.Link,
+			State: n.State,
+		})
+	}
+	for n, inf := range u.Interfaces {
+		pi := &Interface{
+			Index:     int32(inf.Index),
+			Kind:      inf.Kind,
+			Up:        inf.Up,
+			PermAddr:  inf.PermAddr,
+			Managed:   inf.Managed,
+			Carrier:   inf.Carrier,
+			Protodown: inf.ProtoDown,
+			Mac:       inf.MAC,
+		}
+		for _, a := range inf.Addr {
+			pi.Addr = append(pi.Addr, fromAddress(a))
+		}
+		if wg := inf.WireGuard; wg != nil {
+			pi.Wireguard = &WireGuard{
+				Port:  int32(wg.ListenPort),
+				Peers: int32(wg.Peers),
+			}
+		}
+		if st := inf.Stats; st != nil {
+			pi.Stats = &Stats{
+				RxBytes:  st.RxBytes,
+				TxBytes:  st.TxBytes,
+				RxErrors: st.RxErrors,
+				TxErrors: st.TxErrors,
+			}
+		}
+		pu.Interfaces[n] = pi
+	}
+	return pu
+}
+
+func fromAddress(a *ipmon.Address) *Address {
+	if a == nil {
+		return nil
+	}
+	return &Address{
+		Address:   a.Address,
+		Mask:      int32(a.CIDR),
+		Ttl:       int32(a.TTL),
+		Pref:      int32(a.Pref),
+		Temporary: a.Temporary,
+		Stale:     a.Stale,
+		Origin:    a.Origin,
+		Label:     a.Label,
+		Kind:      a.Kind,
+	}
+}
@@ -0,0 +1,41 @@
+package ipmon
+
+import (
+	"testing"
+)
+
+func hasChange(u *Update, change string) bool {
+	for _, c := range u.Change {
+		if c == change {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLinkUpDown brings a link up and down and expects a link update with
+// the matching change for both transitions
+func TestLinkUpDown(t *testing.T) {
+	path, h := testNetns(t)
+	link := testLink(t, h, "ipmon0")
+	updates := monitorNetns(t, DefaultMonitorOptions(), path)
+	waitUpdate(t, updates, func(u *Update) bool { return u.Type == "init" })
+
+	for _, tc := range []struct {
+		change string
+		set    func() error
+	}{
+		{"up", func() error { return h.LinkSetUp(link) }},
+		{"down", func() error { return h.LinkSetDown(link) }},
+	} {
+		if err := tc.set(); err != nil {
+			t.Fatalf("%s: %v", tc.change, err)
+		}
+		u := waitUpdate(t, updates, func(u *Update) bool {
+			return u.Type == "link" && u.Link == "ipmon0" && hasChange(u, tc.change)
+		})
+		if inf := u.Interfaces["ipmon0"]; inf == nil || inf.Up != (tc.change == "up") {
+			t.Errorf("%s: interface state %+v", tc.change, inf)
+		}
+	}
+}
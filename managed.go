@@ -0,0 +1,51 @@
+package ipmon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// state files written by the network managers, keyed by interface index
+var (
+	nmDeviceDir      = "/run/NetworkManager/devices"
+	networkdLinksDir = "/run/systemd/netif/links"
+)
+
+// readKeyFile returns the value of key in a key=value file, ok is false
+// when the file cannot be read or lacks key
+func readKeyFile(name, key string) (string, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, found := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if found && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
+
+// linkManager guesses which daemon controls the interface with index from
+// the state files of NetworkManager and systemd-networkd. It returns
+// networkmanager, networkd or unmanaged when a daemon knows the interface
+// but leaves it alone, and an empty string when neither is running.
+func linkManager(index int) string {
+	nm, nmOk := readKeyFile(fmt.Sprintf("%s/%d", nmDeviceDir, index), "managed")
+	if nmOk && nm == "true" {
+		return "networkmanager"
+	}
+	nd, ndOk := readKeyFile(fmt.Sprintf("%s/%d", networkdLinksDir, index), "ADMIN_STATE")
+	if ndOk && nd != "unmanaged" {
+		return "networkd"
+	}
+	if nmOk || ndOk {
+		return "unmanaged"
+	}
+	return ""
+}
@@ -2,25 +2,48 @@ package ipmon
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 )
 
-var (
-	Debug = log.New(io.Discard, "[DEBUG] ", 0)
-)
+// Debug receives internal diagnostics unless MonitorOptions.Logf is set
+var Debug = log.New(io.Discard, "[DEBUG] ", 0)
 
 type Address struct {
 	N       netlink.Addr `json:"-"`
 	Address string       `json:"address,omitempty"`
 	CIDR    int          `json:"mask,omitempty"`
 	TTL     int          `json:"ttl,omitempty"`
+	Pref    int          `json:"pref,omitempty"`
+	// Temporary is set for IPv6 privacy addresses which rotate
+	Temporary bool `json:"temporary,omitempty"`
+	// Stale is set for addresses retained from before the interface went
+	// down, see MonitorOptions.RetainStaleAddrs
+	Stale bool `json:"stale,omitempty"`
+	// Origin is "static" for permanent addresses and "dynamic" for
+	// addresses with a lifetime, e.g. from DHCP or SLAAC
+	Origin string `json:"origin,omitempty"`
+	// Label is the IPv4 address label, e.g. eth0:0 for legacy aliases
+	Label string `json:"label,omitempty"`
+	// Kind is AddrAnycast or AddrMulticast for the addresses added by
+	// MonitorOptions.IncludeAnycast and IncludeMulticast, empty for
+	// unicast addresses
+	Kind string `json:"kind,omitempty"`
 }
 
 type Route struct {
@@ -28,252 +51,2005 @@ type Route struct {
 	Gateway     string `json:"gateway,omitempty"`
 	Link        string `json:"link,omitempty"`
 	Src         string `json:"src,omitempty"`
-	route       netlink.Route
+	// LinkIndex is the interface index of Link
+	LinkIndex int `json:"ifindex,omitempty"`
+	Metric    int `json:"metric,omitempty"`
+	Table     int `json:"table,omitempty"`
+	// TableName is the name of Table from rt_tables, or the number when
+	// it has no name
+	TableName string `json:"table_name,omitempty"`
+	route     netlink.Route
 }
 
 type Interface struct {
-	Up   bool `json:"up"`
-	link netlink.Link
-	Addr []*Address `json:"addr"`
+	// Index is the kernel interface index
+	Index int `json:"index"`
+	// Kind is the link type as in ip -d link, e.g. device, wireguard or
+	// vlan
+	Kind string `json:"kind,omitempty"`
+	Up   bool   `json:"up"`
+	// Carrier is set when the lower layer is up (IFF_LOWER_UP), an
+	// interface can be up without carrier
+	Carrier bool `json:"carrier"`
+	// ProtoDown is set when the interface was put in protodown, e.g. for
+	// maintenance. It is read from sysfs and always false for other
+	// namespaces.
+	ProtoDown bool `json:"protodown,omitempty"`
+	link      netlink.Link
+	Addr      []*Address `json:"addr"`
+	WireGuard *WireGuard `json:"wireguard,omitempty"`
+	PermAddr  string     `json:"perm_addr,omitempty"`
+	// MAC is the current hardware address, which unlike PermAddr can be
+	// changed, e.g. by bond failover
+	MAC   string `json:"mac,omitempty"`
+	Stats *Stats `json:"stats,omitempty"`
+	// Managed is networkmanager, networkd or unmanaged when a network
+	// manager reports the interface, see linkManager. It is best effort
+	// and left empty for other namespaces.
+	Managed string `json:"managed,omitempty"`
+}
+
+type Stats struct {
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	RxErrors uint64 `json:"rx_errors"`
+	TxErrors uint64 `json:"tx_errors"`
 }
 
+// WireGuard holds device info for wireguard links, only populated with
+// MonitorOptions.WireGuardInfo and when not monitoring another namespace
+type WireGuard struct {
+	ListenPort int `json:"port"`
+	Peers      int `json:"peers"`
+}
+
+// SchemaVersion is the version of the JSON representation of Update. It is
+// incremented whenever fields are added or their meaning changes, removing
+// or renaming fields is avoided.
+const SchemaVersion = 23
+
 type Update struct {
+	// Version is the SchemaVersion the update was generated with
+	Version int      `json:"v"`
 	Type    string   `json:"type,omitempty"`
 	Change  []string `json:"change,omitempty"`
 	Link    string   `json:"link,omitempty"`
-	Address *Address `json:"address,omitempty"`
-	Gateway string   `json:"gateway,omitempty"`
-	Source  string   `json:"source,omitempty"`
+	// LinkKind is the kind of Link for link updates, e.g. wireguard or
+	// vlan, empty for physical devices
+	LinkKind string   `json:"link_kind,omitempty"`
+	Address  *Address `json:"address,omitempty"`
+	Gateway  string   `json:"gateway,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	// Timestamp is the time the snapshot was taken
+	Timestamp time.Time `json:"ts"`
+	// Seq counts the updates passed to the callback, starting from zero
+	// for every call to Monitor
+	Seq uint64 `json:"seq"`
+	// Online is set when there is at least one default route
+	Online bool `json:"online"`
+	// Netns is the name of the namespace the update belongs to when using
+	// MonitorMulti
+	Netns string `json:"netns,omitempty"`
+	// Partial is set when addresses of at least one interface could not be
+	// listed and the snapshot is incomplete
+	Partial bool `json:"partial,omitempty"`
+	// ChangedInterfaces names the interfaces an event update pertains to,
+	// it is empty for snapshots like init and interval
+	ChangedInterfaces []string `json:"changed_interfaces,omitempty"`
+	// RemovedInterfaces names the interfaces of the previous update that
+	// are gone, so that hooks can clean up state kept per interface
+	RemovedInterfaces []string `json:"removed_interfaces,omitempty"`
+	// OldAddress is the temporary address replaced by Address for
+	// temp_addr_rotate updates
+	OldAddress *Address `json:"old_address,omitempty"`
+	// Metric is the metric of the route of a route update, OldMetric the
+	// previous one for change metric_change
+	Metric    int `json:"metric,omitempty"`
+	OldMetric int `json:"old_metric,omitempty"`
+	// WatchedRoute is the prefix of MonitorOptions.WatchRoutes a route
+	// update added or removed a route to, WatchedRouteState is up when it
+	// was added and down when it was removed
+	WatchedRoute      string `json:"watched_route,omitempty"`
+	WatchedRouteState string `json:"watched_route_state,omitempty"`
+	// MAC and OldMAC are the new and previous hardware address of Link
+	// for link updates with change mac_change, or of the default gateway
+	// for neigh updates with change gw_mac_change
+	MAC    string `json:"mac,omitempty"`
+	OldMAC string `json:"old_mac,omitempty"`
+	// Hostname and BootID identify the host and its current boot when
+	// MonitorOptions.IncludeHost is set
+	Hostname string `json:"hostname,omitempty"`
+	BootID   string `json:"boot_id,omitempty"`
 
-	Routes     []*Route              `json:"routes"`
-	Interfaces map[string]*Interface `json:"interfaces"`
+	Routes     []*Route              `json:"routes,omitempty"`
+	Interfaces map[string]*Interface `json:"interfaces,omitempty"`
+	Rules      []*Rule               `json:"rules,omitempty"`
+	// Neighbors holds the resolved ARP and NDP entries when
+	// MonitorOptions.WatchNeigh is set
+	Neighbors []*Neighbor `json:"neighbors,omitempty"`
+	// DelegatedPrefixes holds IPv6 prefixes delegated to the host by
+	// DHCPv6-PD, see delegatedPrefix
+	DelegatedPrefixes []string `json:"delegated_prefixes,omitempty"`
+	// Raw describes the netlink message behind an event update when
+	// MonitorOptions.IncludeRaw is set
+	Raw *Raw `json:"raw,omitempty"`
+
+	linkNames map[int]string
+	// order holds the interface names sorted by index
+	order []string
+}
+
+// interfaceNames returns the names of all interfaces ordered by index, or
+// by name when the update was not created by a snapshot
+func (u *Update) interfaceNames() []string {
+	if len(u.order) == len(u.Interfaces) {
+		return u.order
+	}
+	names := make([]string, 0, len(u.Interfaces))
+	for n := range u.Interfaces {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
 }
 
+// MarshalEnv returns the update as a sorted list of KEY=VALUE strings
+// suitable for passing as the environment of a process. Values are not
+// quoted, exec passes them as-is so spaces and quotes are preserved, use
+// MarshalEnvShell for output that is read by a shell.
 func (u *Update) MarshalEnv() (env []string) {
-	env = append(env, fmt.Sprintf("IPMON_TYPE=%s", u.Type))
+	return u.MarshalEnvSep(" ")
+}
+
+// MarshalEnvSep is like MarshalEnv but joins the values of list variables
+// such as IPMON_CHANGE and IPMON_IFACES with sep instead of a space
+func (u *Update) MarshalEnvSep(sep string) (env []string) {
+	for k, v := range u.MarshalEnvMapSep(sep) {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// MarshalEnvShell returns the variables of MarshalEnv as sorted
+// export KEY='value' lines that can be sourced by a POSIX shell
+func (u *Update) MarshalEnvShell() (lines []string) {
+	for k, v := range u.MarshalEnvMap() {
+		lines = append(lines, "export "+k+"="+shellQuote(v))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// shellQuote wraps s in single quotes, a single quote inside s ends the
+// quoted string, adds an escaped quote and starts a new one
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// minimalEnv lists the variables returned by MarshalEnvMinimal
+var minimalEnv = []string{
+	"IPMON_TYPE", "IPMON_ONLINE", "IPMON_PARTIAL",
+	"IPMON_IPV4", "IPMON_IPV4_IF", "IPMON_IPV4_GW",
+	"IPMON_IPV6", "IPMON_IPV6_IF", "IPMON_IPV6_GW",
+}
+
+// MarshalEnvMinimal is like MarshalEnv but only returns the update type,
+// the online and partial state and the default route variables
+func (u *Update) MarshalEnvMinimal() (env []string) {
+	m := u.MarshalEnvMap()
+	for _, k := range minimalEnv {
+		if v, ok := m[k]; ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// MarshalEnvInterface is like MarshalEnvMinimal but for hosts whose
+// uplinks are the named interfaces. IPMON_IPV4 and IPMON_IPV6 hold the
+// primary addresses of the first interface that has one, whether or not a
+// default route uses it, and IPMON_IPV4_<iface> and IPMON_IPV6_<iface>
+// those of every named interface. The gateway is only included when the
+// default route uses the selected interface.
+func (u *Update) MarshalEnvInterface(names ...string) (env []string) {
+	m := u.MarshalEnvMap()
+	out := map[string]string{}
+	for _, k := range minimalEnv {
+		if v, ok := m[k]; ok {
+			out[k] = v
+		}
+	}
+	for _, family := range []string{"IPV4", "IPV6"} {
+		prefix := "IPMON_" + family
+		delete(out, prefix)
+		delete(out, prefix+"_IF")
+		delete(out, prefix+"_GW")
+		for _, name := range names {
+			addr, ok := m[prefix+"_"+envName(name)]
+			if !ok {
+				continue
+			}
+			out[prefix+"_"+envName(name)] = addr
+			if _, ok := out[prefix]; ok {
+				continue
+			}
+			out[prefix] = addr
+			out[prefix+"_IF"] = name
+			if gw, ok := m[prefix+"_GW"]; ok && m[prefix+"_IF"] == name {
+				out[prefix+"_GW"] = gw
+			}
+		}
+	}
+	for k, v := range out {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// MarshalEnvMap returns the same variables as MarshalEnv as a map. When a
+// key would be set more than once, such as for an interface with several
+// addresses of the same family, the first value is kept.
+func (u *Update) MarshalEnvMap() map[string]string {
+	return u.MarshalEnvMapSep(" ")
+}
+
+// MarshalEnvMapSep is like MarshalEnvMap but joins the values of list
+// variables with sep, see MarshalEnvSep
+func (u *Update) MarshalEnvMapSep(sep string) map[string]string {
+	env := make(map[string]string)
+	set := func(key string, format string, a ...any) {
+		if _, ok := env[key]; !ok {
+			env[key] = fmt.Sprintf(format, a...)
+		}
+	}
+	set("IPMON_TYPE", "%s", u.Type)
+	set("IPMON_SEQ", "%d", u.Seq)
+	// the first update passed to the callback, whatever its type
+	if u.Seq == 0 {
+		set("IPMON_FIRST", "1")
+	} else {
+		set("IPMON_FIRST", "0")
+	}
+	if u.Online {
+		set("IPMON_ONLINE", "1")
+	} else {
+		set("IPMON_ONLINE", "0")
+	}
+	if u.Netns != "" {
+		set("IPMON_NETNS", "%s", u.Netns)
+	}
+	if u.Partial {
+		set("IPMON_PARTIAL", "1")
+	}
+	if u.Hostname != "" {
+		set("IPMON_HOSTNAME", "%s", u.Hostname)
+	}
+	if u.BootID != "" {
+		set("IPMON_BOOT_ID", "%s", u.BootID)
+	}
+	if !u.Timestamp.IsZero() {
+		set("IPMON_TS", "%s", u.Timestamp.Format(time.RFC3339))
+	}
+	if len(u.Change) > 0 {
+		set("IPMON_CHANGE", "%s", strings.Join(u.Change, sep))
+		for i, c := range u.Change {
+			set(fmt.Sprintf("IPMON_CHANGE_%d", i), "%s", c)
+		}
+	}
+	if u.Address != nil {
+		set("IPMON_ADDR", "%s", u.Address.Address)
+		set("IPMON_MASK", "%d", u.Address.CIDR)
+	}
+	if u.OldAddress != nil {
+		set("IPMON_OLD_ADDR", "%s", u.OldAddress.Address)
+		set("IPMON_OLD_MASK", "%d", u.OldAddress.CIDR)
+	}
+	if u.Gateway != "" {
+		set("IPMON_GW", "%s", u.Gateway)
+	}
+	if u.Source != "" {
+		set("IPMON_SRC", "%s", u.Source)
+	}
+
+	var ifaces []string
+	for _, name := range u.interfaceNames() {
+		inf := u.Interfaces[name]
+		n := envName(name)
+		ifaces = append(ifaces, n+":"+name)
+		vars := inf.env(sep)
+		for _, v := range vars {
+			set(fmt.Sprintf("IPMON_%s_%s%s", v.key, n, v.suffix), "%s", v.value)
+		}
+		if mac := inf.PermAddr; mac != "" {
+			mac = strings.ReplaceAll(mac, ":", "")
+			set(fmt.Sprintf("IPMON_BYMAC_%s_NAME", mac), "%s", name)
+			for _, v := range vars {
+				set(fmt.Sprintf("IPMON_BYMAC_%s_%s%s", mac, v.key, v.suffix), "%s", v.value)
+			}
+		}
+	}
+	hasGlobal := false
+	for _, inf := range u.Interfaces {
+		hasGlobal = hasGlobal || inf.hasGlobal()
+	}
+	if hasGlobal {
+		set("IPMON_HAS_GLOBAL", "1")
+	} else if len(u.Interfaces) > 0 {
+		set("IPMON_HAS_GLOBAL", "0")
+	}
+	if len(ifaces) > 0 {
+		sort.Strings(ifaces)
+		set("IPMON_IFACES", "%s", strings.Join(ifaces, sep))
+	}
+	if u.Link != "" {
+		set("IPMON_LINK", "%s", u.Link)
+	}
+	if u.LinkKind != "" {
+		set("IPMON_LINK_KIND", "%s", u.LinkKind)
+	}
+	if len(u.ChangedInterfaces) > 0 {
+		set("IPMON_CHANGED_IFACES", "%s", strings.Join(u.ChangedInterfaces, sep))
+	}
+	if len(u.RemovedInterfaces) > 0 {
+		set("IPMON_REMOVED_IFACES", "%s", strings.Join(u.RemovedInterfaces, sep))
+	}
+	if u.Type == "route" || u.Type == "default_route" {
+		set("IPMON_METRIC", "%d", u.Metric)
+		if len(u.Change) == 1 && u.Change[0] == "metric_change" {
+			set("IPMON_OLD_METRIC", "%d", u.OldMetric)
+		}
+	}
+	if u.WatchedRoute != "" {
+		set("IPMON_WATCHED_ROUTE", "%s", u.WatchedRoute)
+		set("IPMON_WATCHED_ROUTE_STATE", "%s", u.WatchedRouteState)
+	}
+	if u.MAC != "" {
+		set("IPMON_MAC", "%s", u.MAC)
+	}
+	var gwRoutes []string
+	for _, r := range u.Routes {
+		if r.Gateway == "" {
+			continue
+		}
+		set(fmt.Sprintf("IPMON_GW_ROUTE_%d", len(gwRoutes)), "%s via %s dev %s", r.Destination, r.Gateway, r.Link)
+		gwRoutes = append(gwRoutes, r.Destination)
+	}
+	if len(gwRoutes) > 0 {
+		set("IPMON_GW_ROUTES", "%s", strings.Join(gwRoutes, sep))
+	}
+	if u.OldMAC != "" {
+		set("IPMON_OLD_MAC", "%s", u.OldMAC)
+	}
+
+	for i, r := range u.Rules {
+		set(fmt.Sprintf("IPMON_RULE_%d", i), "%s", r)
+	}
+	for i, n := range u.Neighbors {
+		set(fmt.Sprintf("IPMON_NEIGH_%d", i), "%s", n)
+	}
+	for i, p := range u.DelegatedPrefixes {
+		set(fmt.Sprintf("IPMON_PD_%d", i), "%s", p)
+	}
+
+	defRouteIPv4, defRouteIPv6 := u.defaultRoutes()
+
+	if defRouteIPv4 != nil {
+		if src := u.ipv4Source(defRouteIPv4); src != "" {
+			set("IPMON_IPV4", "%s", src)
+		}
+		set("IPMON_IPV4_IF", "%s", defRouteIPv4.Link)
+		if defRouteIPv4.TableName != "" {
+			set("IPMON_IPV4_TABLE", "%s", defRouteIPv4.TableName)
+		}
+		if defRouteIPv4.route.Gw != nil {
+			set("IPMON_IPV4_GW", "%s", defRouteIPv4.route.Gw.String())
+			if mac := u.gatewayMAC(defRouteIPv4); mac != "" {
+				set("IPMON_IPV4_GW_MAC", "%s", mac)
+			}
+		}
+		set("IPMON_IPV4_METRIC", "%d", defRouteIPv4.Metric)
+	}
+	if defRouteIPv6 != nil {
+		if src := u.ipv6Source(defRouteIPv6); src != "" {
+			set("IPMON_IPV6", "%s", src)
+		}
+		set("IPMON_IPV6_IF", "%s", defRouteIPv6.Link)
+		if defRouteIPv6.TableName != "" {
+			set("IPMON_IPV6_TABLE", "%s", defRouteIPv6.TableName)
+		}
+		if defRouteIPv6.route.Gw != nil {
+			set("IPMON_IPV6_GW", "%s", defRouteIPv6.route.Gw.String())
+			if mac := u.gatewayMAC(defRouteIPv6); mac != "" {
+				set("IPMON_IPV6_GW_MAC", "%s", mac)
+			}
+		}
+		set("IPMON_IPV6_METRIC", "%d", defRouteIPv6.Metric)
+	}
+
+	return env
+}
+
+// String returns a one line summary of u for logging
+func (u *Update) String() string {
+	var b strings.Builder
+	b.WriteString(u.Type)
 	if len(u.Change) > 0 {
-		env = append(env, fmt.Sprintf("IPMON_CHANGE=%s", u.Change[0]))
+		fmt.Fprintf(&b, " %v", u.Change)
+	}
+	if u.Link != "" {
+		fmt.Fprintf(&b, " link=%s", u.Link)
 	}
 	if u.Address != nil {
-		env = append(env, fmt.Sprintf("IPMON_ADDR=%s", u.Address.Address))
-		env = append(env, fmt.Sprintf("IPMON_MASK=%d", u.Address.CIDR))
+		fmt.Fprintf(&b, " addr=%s/%d", u.Address.Address, u.Address.CIDR)
 	}
 	if u.Gateway != "" {
-		env = append(env, fmt.Sprintf("IPMON_GW=%s", u.Gateway))
+		fmt.Fprintf(&b, " gw=%s", u.Gateway)
+	}
+	if u.Source != "" {
+		fmt.Fprintf(&b, " src=%s", u.Source)
+	}
+	if u.Partial {
+		b.WriteString(" partial")
+	}
+	v4, v6 := u.defaultRoutes()
+	if v4 != nil {
+		if src := u.ipv4Source(v4); src != "" {
+			fmt.Fprintf(&b, " ipv4=%s", src)
+		}
+		if v4.Gateway != "" {
+			fmt.Fprintf(&b, " gw4=%s", v4.Gateway)
+		}
+	}
+	if v6 != nil {
+		if src := u.ipv6Source(v6); src != "" {
+			fmt.Fprintf(&b, " ipv6=%s", src)
+		}
+		if v6.Gateway != "" {
+			fmt.Fprintf(&b, " gw6=%s", v6.Gateway)
+		}
+	}
+	return b.String()
+}
+
+// primary returns the IPv4 and IPv6 source addresses of the default
+// routes, as in IPMON_IPV4 and IPMON_IPV6
+func (u *Update) primary() (p [2]string) {
+	v4, v6 := u.defaultRoutes()
+	if v4 != nil {
+		p[0] = u.ipv4Source(v4)
+	}
+	if v6 != nil {
+		p[1] = u.ipv6Source(v6)
+	}
+	return p
+}
+
+// defaultRoutes returns the IPv4 and IPv6 default routes with the lowest
+// metric
+func (u *Update) defaultRoutes() (v4, v6 *Route) {
+	for _, r := range u.Routes {
+		if !isDefault(r.route.Dst) {
+			continue
+		}
+		switch r.route.Family {
+		case netlink.FAMILY_V4:
+			if v4 == nil || r.route.Priority < v4.route.Priority {
+				v4 = r
+			}
+		case netlink.FAMILY_V6:
+			if v6 == nil || r.route.Priority < v6.route.Priority {
+				v6 = r
+			}
+		}
+	}
+	return
+}
+
+// ipv4Source selects the IPv4 source address for the default route r. The
+// route source is used when set, otherwise the primary global address on
+// the egress interface. Host addresses (/32) qualify like any other, the
+// route source may also live on another interface such as lo.
+func (u *Update) ipv4Source(r *Route) string {
+	if src := r.route.Src.To4(); src != nil {
+		return src.String()
+	}
+	inf := u.Interfaces[r.Link]
+	if inf == nil {
+		return ""
+	}
+	var best *Address
+	for _, a := range inf.Addr {
+		ip := net.ParseIP(a.Address)
+		if ip.To4() == nil || !ip.IsGlobalUnicast() || a.Stale {
+			continue
+		}
+		if best == nil || (a.N.Flags&unix.IFA_F_SECONDARY == 0 && best.N.Flags&unix.IFA_F_SECONDARY != 0) {
+			best = a
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Address
+}
+
+// ipv6Source selects the canonical IPv6 source address for the default
+// route r. The route source is used unless it is a temporary address,
+// otherwise the first stable address on the egress interface is chosen,
+// preferring permanent addresses over other non-temporary, non-deprecated
+// global addresses.
+func (u *Update) ipv6Source(r *Route) string {
+	inf := u.Interfaces[r.Link]
+	if r.route.Src.To16() != nil {
+		src := r.route.Src.String()
+		temporary := false
+		if inf != nil {
+			for _, a := range inf.Addr {
+				if a.Address == src && a.Temporary {
+					temporary = true
+				}
+			}
+		}
+		if !temporary {
+			return src
+		}
+	}
+	if inf == nil {
+		return ""
+	}
+	var best *Address
+	for _, a := range inf.Addr {
+		ip := net.ParseIP(a.Address)
+		if ip.To4() != nil || !ip.IsGlobalUnicast() || ip.IsPrivate() || !a.stable() {
+			continue
+		}
+		if best == nil || (a.N.Flags&unix.IFA_F_PERMANENT != 0 && best.N.Flags&unix.IFA_F_PERMANENT == 0) {
+			best = a
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Address
+}
+
+// stable reports whether a is usable and not expected to rotate
+func (a *Address) stable() bool {
+	return a.Kind == "" && !a.Temporary && !a.Stale && a.N.Flags&(unix.IFA_F_DEPRECATED|unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) == 0
+}
+
+// envName turns an interface name into something usable in an environment
+// variable name by replacing anything outside [A-Za-z0-9_] with _ and
+// converting it to upper case
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Fingerprint returns a digest of the interfaces, addresses and routes in u,
+// volatile fields such as address lifetimes are left out so that two
+// snapshots of an unchanged network produce the same fingerprint
+func (u *Update) Fingerprint() string {
+	h := sha256.New()
+	names := make([]string, 0, len(u.Interfaces))
+	for n := range u.Interfaces {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		inf := u.Interfaces[n]
+		fmt.Fprintf(h, "if %s %t\n", n, inf.Up)
+		var addrs []string
+		for _, a := range inf.Addr {
+			addrs = append(addrs, fmt.Sprintf("addr %s/%d\n", a.Address, a.CIDR))
+		}
+		sort.Strings(addrs)
+		for _, a := range addrs {
+			io.WriteString(h, a)
+		}
+	}
+	var routes []string
+	for _, r := range u.Routes {
+		routes = append(routes, fmt.Sprintf("route %s %s %s %s\n", r.Destination, r.Gateway, r.Link, r.Src))
+	}
+	sort.Strings(routes)
+	for _, r := range routes {
+		io.WriteString(h, r)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type envVar struct {
+	key string
+	// suffix is appended after the interface name
+	suffix string
+	value  string
+}
+
+// linkProtoDown reports whether interface name is in protodown
+func linkProtoDown(name string) bool {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "proto_down"))
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+// addrOrigin classifies an address by its flags, the kernel marks
+// addresses without a lifetime as permanent
+func addrOrigin(flags int) string {
+	if flags&unix.IFA_F_PERMANENT != 0 {
+		return "static"
+	}
+	return "dynamic"
+}
+
+// env returns the per-interface variables without the interface suffix,
+// sep joins list values
+func (inf *Interface) env(sep string) (vars []envVar) {
+	add := func(key string, format string, a ...any) {
+		vars = append(vars, envVar{key: key, value: fmt.Sprintf(format, a...)})
+	}
+	var anycast, multicast []string
+	for i, a := range inf.Addr {
+		switch a.Kind {
+		case AddrAnycast:
+			anycast = append(anycast, a.Address)
+			continue
+		case AddrMulticast:
+			multicast = append(multicast, a.Address)
+			continue
+		}
+		// ADDR names the address the ORIGIN and LABEL of the same index
+		// belong to
+		vars = append(vars, envVar{key: "ADDR", suffix: fmt.Sprintf("_%d", i), value: fmt.Sprintf("%s/%d", a.Address, a.CIDR)})
+		if a.Origin != "" {
+			vars = append(vars, envVar{key: "ORIGIN", suffix: fmt.Sprintf("_%d", i), value: a.Origin})
+		}
+		if a.Label != "" {
+			vars = append(vars, envVar{key: "LABEL", suffix: fmt.Sprintf("_%d", i), value: a.Label})
+		}
+		ip := net.ParseIP(a.Address)
+		if a.Stale {
+			if ip.To4() != nil {
+				add("STALE_IPV4", "%s", a.Address)
+			} else {
+				add("STALE_IPV6", "%s", a.Address)
+			}
+			continue
+		}
+		if ip.IsLinkLocalUnicast() {
+			if ip.To4() != nil {
+				add("LL_IPV4", "%s", a.Address)
+			} else if ip.To16() != nil {
+				add("LL_IPV6", "%s", a.Address)
+			}
+		}
+
+		if !ip.IsGlobalUnicast() {
+			continue
+		}
+		if ip.To4() != nil {
+			if a.TTL > 0 {
+				add("IPV4_TTL", "%d", a.TTL)
+			}
+			if a.Pref > 0 {
+				add("IPV4_PREF", "%d", a.Pref)
+			}
+			add("IPV4", "%s", a.Address)
+			add("IPV4_MASK", "%d", a.CIDR)
+		} else if ip.To16() != nil {
+			if ip.IsPrivate() {
+				continue
+			}
+			if a.TTL > 0 {
+				add("IPV6_TTL", "%d", a.TTL)
+			}
+			if a.Pref > 0 {
+				add("IPV6_PREF", "%d", a.Pref)
+			}
+			add("IPV6", "%s", a.Address)
+			add("IPV6_MASK", "%d", a.CIDR)
+		}
+	}
+
+	if len(anycast) > 0 {
+		add("ANYCAST", "%s", strings.Join(anycast, sep))
+	}
+	if len(multicast) > 0 {
+		add("MULTICAST", "%s", strings.Join(multicast, sep))
+	}
+
+	if inf.WireGuard != nil {
+		add("WG_PORT", "%d", inf.WireGuard.ListenPort)
+		add("WG_PEERS", "%d", inf.WireGuard.Peers)
+	}
+
+	add("IFINDEX", "%d", inf.Index)
+	if inf.MAC != "" {
+		add("MAC", "%s", inf.MAC)
+	}
+	if inf.Managed != "" {
+		add("MANAGED", "%s", inf.Managed)
+	}
+	if inf.Up {
+		add("UP", "1")
+	} else {
+		add("UP", "0")
+	}
+	if inf.Carrier {
+		add("CARRIER", "1")
+	} else {
+		add("CARRIER", "0")
+	}
+	if inf.ProtoDown {
+		add("PROTODOWN", "1")
+	} else {
+		add("PROTODOWN", "0")
+	}
+	if inf.hasGlobal() {
+		add("HAS_GLOBAL", "1")
+	} else {
+		add("HAS_GLOBAL", "0")
+	}
+	return
+}
+
+// retainStale adds the addresses of prev that are missing from inf as
+// stale addresses
+func (inf *Interface) retainStale(prev *Interface) {
+	if prev == nil {
+		return
+	}
+	for _, pa := range prev.Addr {
+		found := false
+		for _, a := range inf.Addr {
+			if a.Address == pa.Address && a.CIDR == pa.CIDR {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale := *pa
+			stale.Stale = true
+			inf.Addr = append(inf.Addr, &stale)
+		}
+	}
+}
+
+// hasGlobal reports whether inf has a global IPv4 or non-ULA IPv6 address,
+// the same addresses that are exported as IPMON_IPV4_<iface> and
+// IPMON_IPV6_<iface>
+func (inf *Interface) hasGlobal() bool {
+	for _, a := range inf.Addr {
+		ip := net.ParseIP(a.Address)
+		if a.Stale || a.Kind != "" || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if ip.To4() != nil || !ip.IsPrivate() {
+			return true
+		}
+	}
+	return false
+}
+
+// MonitorOptions controls the behaviour of MonitorWithOptions. The zero
+// value subscribes to nothing and is rejected by MonitorContext, start
+// from DefaultMonitorOptions and change what differs instead.
+type MonitorOptions struct {
+	// Interval triggers a full update periodically, zero disables it
+	Interval time.Duration
+	// SkipInitial suppresses the update of type init sent on startup
+	SkipInitial bool
+	// LifetimeWarning sends an update of type lifetime this long before
+	// the valid lifetime of an address expires, zero disables it
+	LifetimeWarning time.Duration
+	// IncludeStats adds interface counters to interval updates, other
+	// updates leave them out
+	IncludeStats bool
+	// IncludeLinkLocal includes link-local addresses in snapshots and
+	// lets changes to them trigger updates. It is set by
+	// DefaultMonitorOptions, a MonitorOptions built from scratch leaves
+	// link-local addresses out.
+	IncludeLinkLocal bool
+	// IncludeAnycast and IncludeMulticast add the IPv6 anycast addresses
+	// and the multicast groups joined by each interface to snapshots,
+	// tagged with Address.Kind. They are read from /proc/net and not
+	// available with Netns. Joining or leaving a group does not trigger an
+	// update.
+	IncludeAnycast   bool
+	IncludeMulticast bool
+	// RefreshWindow holds back address deletions for this long, if the
+	// same address is added again within the window a single update with
+	// change "refresh" is sent instead of a delete and an add
+	RefreshWindow time.Duration
+	// Netns is the path of a network namespace to monitor instead of the
+	// current one, e.g. /var/run/netns/foo
+	Netns string
+	// Scopes restricts addresses to the given scopes. When empty global
+	// unicast addresses and, depending on IncludeLinkLocal, link-local
+	// addresses are included
+	Scopes []netlink.Scope
+	// RouteProtocols restricts routes to those installed by one of the
+	// protocols, e.g. unix.RTPROT_STATIC or unix.RTPROT_DHCP. When empty
+	// routes of every protocol are included
+	RouteProtocols []netlink.RouteProtocol
+	// ExcludeRouteProtocols leaves out routes installed by one of the
+	// protocols, e.g. unix.RTPROT_KERNEL
+	ExcludeRouteProtocols []netlink.RouteProtocol
+	// WatchRules subscribes to policy routing rule changes and includes
+	// the rules in every update
+	WatchRules bool
+	// FullSnapshotOnEvent includes routes, interfaces and rules in every
+	// update. When disabled only init, interval and resync updates carry
+	// the full state and event updates only describe the change. It is
+	// set by DefaultMonitorOptions, a MonitorOptions built from scratch
+	// sends slim event updates.
+	FullSnapshotOnEvent bool
+	// WatchDestinations limits route updates to default routes and routes
+	// to destinations within one of the prefixes, other routes are still
+	// included in snapshots
+	WatchDestinations []net.IPNet
+	// WatchRoutes are prefixes whose routes are tracked, route updates
+	// adding or removing a route to exactly one of them carry it in
+	// Update.WatchedRoute
+	WatchRoutes []net.IPNet
+	// RequireGateway limits route updates to default routes and routes
+	// with a gateway, ignoring the churn of directly connected routes.
+	// Snapshots still include every route.
+	RequireGateway bool
+	// MinInterval is the minimum time between two updates, updates in
+	// between are coalesced and the latest one is delivered once the
+	// interval has passed
+	MinInterval time.Duration
+	// StartupSettle holds back all updates, including the initial one, for
+	// this long after monitoring starts or until a default route first
+	// appears. The state at that point is then delivered as a single init
+	// update, giving fn a stable picture instead of every step of a boot.
+	// With SkipInitial it is only delivered when events were coalesced.
+	StartupSettle time.Duration
+	// FlapThreshold is the number of event updates within FlapWindow, 10
+	// seconds by default, above which the network is considered flapping.
+	// A single update of type flapping is delivered and all updates are
+	// dropped until a window passes without exceeding the threshold, then
+	// an update of type stable with the current state follows. Zero
+	// disables the check.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	// RetainStaleAddrs keeps the last known addresses of an interface that
+	// went down, marked as stale, for as long as it stays down
+	RetainStaleAddrs bool
+	// StallTimeout forces a full resync, delivered as a "resync" update,
+	// when neither a netlink event nor an interval tick was received for
+	// this long
+	StallTimeout time.Duration
+	// IntervalJitter randomizes every interval period by up to plus or
+	// minus this duration
+	IntervalJitter time.Duration
+	// WatchAddr, WatchRoute and WatchLink subscribe to address, route and
+	// link changes, all are enabled by DefaultMonitorOptions. Snapshots
+	// always include addresses, routes and links. At least one of them,
+	// WatchNeigh or WatchRules must be set.
+	WatchAddr  bool
+	WatchRoute bool
+	WatchLink  bool
+	// WatchNeigh subscribes to neighbor (ARP and NDP) changes and sends a
+	// "neigh" update when an entry is resolved, changes link layer address
+	// or is removed. Snapshots then include the neighbor table, leaving out
+	// incomplete and failed entries.
+	WatchNeigh bool
+	// RecvBufferSize sets the receive buffer size of the netlink
+	// subscriptions in bytes, a larger buffer avoids losing events during
+	// bursts. The kernel caps it at net.core.rmem_max.
+	RecvBufferSize int
+	// ForceRecvBuffer uses SO_RCVBUFFORCE to exceed net.core.rmem_max,
+	// which requires CAP_NET_ADMIN
+	ForceRecvBuffer bool
+	// OnlyPrimaryChange only sends event updates when the primary IPv4 or
+	// IPv6 address, the source of the default route, changed since the
+	// last update. Init, interval and resync updates are always sent.
+	OnlyPrimaryChange bool
+	// Interfaces restricts snapshots and events to the named interfaces,
+	// routes through other interfaces are left out. When empty every
+	// interface is monitored.
+	Interfaces []string
+	// ChannelBuffer is the number of netlink events buffered per
+	// subscription while fn runs, at least 1. Events that do not fit stay
+	// in the socket receive buffer, see RecvBufferSize, and are lost when
+	// that overflows too. A larger buffer uses more memory but rides out
+	// bursts with a slow fn.
+	ChannelBuffer int
+	// IncludeRaw sets Update.Raw to the netlink message type and flags of
+	// the event that caused the update
+	IncludeRaw bool
+	// IncludeHost sets Update.Hostname and Update.BootID, read once when
+	// monitoring starts, so that collectors can group updates per host
+	// and boot
+	IncludeHost bool
+	// WireGuardInfo returns the device info of the wireguard link name,
+	// e.g. wireguard.Info of the bonan.se/ipmon/wireguard module. It is
+	// not called with Netns.
+	WireGuardInfo func(name string) (*WireGuard, error)
+	// Logf receives internal diagnostics such as ignored netlink errors,
+	// when nil they are written to Debug
+	Logf func(format string, args ...any)
+	// Started is called once the netlink subscriptions are set up and the
+	// initial snapshot was taken, also when SkipInitial keeps it from
+	// being delivered
+	Started func()
+}
+
+// DefaultMonitorOptions returns the options used by Monitor
+func DefaultMonitorOptions() MonitorOptions {
+	return MonitorOptions{
+		IncludeLinkLocal:    true,
+		FullSnapshotOnEvent: true,
+		WatchAddr:           true,
+		WatchRoute:          true,
+		WatchLink:           true,
+	}
+}
+
+// Monitor calls fn with an initial update and then for every change,
+// interval is given in seconds. Every call gets an update of its own that
+// fn may keep or pass to other goroutines.
+func Monitor(ctx context.Context, interval int, fn func(*Update)) error {
+	opts := DefaultMonitorOptions()
+	opts.Interval = time.Duration(interval) * time.Second
+	return MonitorWithOptions(ctx, opts, fn)
+}
+
+// MonitorWithOptions is like Monitor but takes MonitorOptions
+func MonitorWithOptions(ctx context.Context, opts MonitorOptions, fn func(*Update)) error {
+	return MonitorFunc(ctx, opts, func(u *Update) error {
+		fn(u)
+		return nil
+	})
+}
+
+// MonitorFunc is like MonitorWithOptions but stops monitoring and returns
+// the error as soon as fn returns a non-nil error
+func MonitorFunc(ctx context.Context, opts MonitorOptions, fn func(*Update) error) error {
+	return MonitorContext(ctx, opts, func(_ context.Context, u *Update) error {
+		return fn(u)
+	})
+}
+
+// MonitorContext is like MonitorFunc but also passes ctx to fn so that it
+// can observe cancellation. An error listing links or routes for the
+// initial snapshot is returned, later failures skip the event. When ctx is
+// done before the initial snapshot completes its error is returned, as
+// is an error when opts does not subscribe to any change.
+func MonitorContext(ctx context.Context, opts MonitorOptions, fn func(context.Context, *Update) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !opts.WatchAddr && !opts.WatchRoute && !opts.WatchLink && !opts.WatchNeigh && !opts.WatchRules {
+		return errors.New("no changes to watch, set WatchAddr, WatchRoute, WatchLink, WatchNeigh or WatchRules")
+	}
+	m := &monitor{opts: opts, tables: readTableNames()}
+	var seq uint64
+	var online bool
+	var hostname, bootID string
+	if opts.IncludeHost {
+		hostname, bootID = m.hostInfo()
+	}
+	// interfaces of the previously delivered update
+	var delivered map[string]*Interface
+	deliver := func(u *Update) error {
+		u.Version = SchemaVersion
+		u.Seq = seq
+		u.Hostname, u.BootID = hostname, bootID
+		u.RemovedInterfaces = nil
+		for name := range delivered {
+			if _, ok := u.Interfaces[name]; !ok {
+				u.RemovedInterfaces = append(u.RemovedInterfaces, name)
+			}
+		}
+		sort.Strings(u.RemovedInterfaces)
+		delivered = u.Interfaces
+		seq++
+		out := u
+		if !opts.FullSnapshotOnEvent && u.Type != "init" && u.Type != "interval" && u.Type != "resync" {
+			slim := *u
+			slim.Routes = nil
+			slim.Interfaces = nil
+			slim.Rules = nil
+			slim.Neighbors = nil
+			out = &slim
+		}
+		// fn gets its own copy, lastUpdate keeps changing after it returns
+		return fn(ctx, out.Clone())
+	}
+
+	// with MinInterval set updates arriving too soon after the previous
+	// one are held back and only the latest is delivered when it expires
+	var lastEmit time.Time
+	var held *Update
+	rateTmr := newStoppedTimer()
+	defer rateTmr.Stop()
+	// with OnlyPrimaryChange event updates are dropped unless the source
+	// address of a default route changed since the last emitted update
+	var lastPrimary [2]string
+	// with StartupSettle updates are dropped until the window ends or the
+	// host comes online, the latest state is then delivered as init
+	settleTmr := newStoppedTimer()
+	defer settleTmr.Stop()
+	settling := opts.StartupSettle > 0
+	settleEvents := false
+	settle := func(u *Update) error {
+		stopTimer(settleTmr)
+		settling = false
+		if opts.SkipInitial && !settleEvents {
+			return nil
+		}
+		init := u.asSnapshot("init")
+		lastPrimary = init.primary()
+		lastEmit = time.Now()
+		return deliver(init)
+	}
+	// with FlapThreshold more event updates than that within FlapWindow
+	// send a flapping update and drop all updates until a window passes
+	// below the threshold, which is reported as stable
+	flapWindow := opts.FlapWindow
+	if flapWindow <= 0 {
+		flapWindow = 10 * time.Second
+	}
+	var flapEvents []time.Time
+	flapping := false
+	flapTmr := newStoppedTimer()
+	defer flapTmr.Stop()
+	countFlap := func() int {
+		i := 0
+		for i < len(flapEvents) && time.Since(flapEvents[i]) > flapWindow {
+			i++
+		}
+		flapEvents = flapEvents[i:]
+		return len(flapEvents)
+	}
+	// pass delivers u unless settling, flapping, OnlyPrimaryChange or
+	// MinInterval hold it back
+	pass := func(u *Update) error {
+		// online and offline updates follow the event that caused them,
+		// they are not counted as events of their own
+		follows := u.Type == "online" || u.Type == "offline"
+		if settling {
+			if u.Type == "init" || u.Type == "interval" {
+				return nil
+			}
+			settleEvents = true
+			if u.Online && !online {
+				return settle(u)
+			}
+			return nil
+		}
+		if opts.FlapThreshold > 0 && !follows && u.Type != "init" && u.Type != "interval" && u.Type != "resync" {
+			flapEvents = append(flapEvents, time.Now())
+			if !flapping && countFlap() > opts.FlapThreshold {
+				m.logf("more than %d events in %s, flapping", opts.FlapThreshold, flapWindow)
+				flapping = true
+				flapTmr.Reset(flapWindow)
+				stopTimer(rateTmr)
+				held = nil
+				lastEmit = time.Now()
+				return deliver(u.asSnapshot("flapping"))
+			}
+		}
+		if flapping {
+			return nil
+		}
+		if opts.OnlyPrimaryChange {
+			p := u.primary()
+			if p == lastPrimary && !follows && u.Type != "init" && u.Type != "interval" && u.Type != "resync" {
+				return nil
+			}
+			lastPrimary = p
+		}
+		if opts.MinInterval > 0 && u.Type != "init" {
+			if wait := opts.MinInterval - time.Since(lastEmit); wait > 0 {
+				if held == nil {
+					rateTmr.Reset(wait)
+				}
+				held = u
+				return nil
+			}
+		}
+		lastEmit = time.Now()
+		return deliver(u)
+	}
+	// emit passes u on, followed by an online or offline update when u
+	// added the first default route or removed the last one. That update
+	// is a snapshot of the same state and passes the same checks as u.
+	emit := func(u *Update) error {
+		wasSettling, wasOnline := settling, online
+		if err := pass(u); err != nil {
+			return err
+		}
+		online = u.Online
+		if u.Type == "init" || wasSettling || u.Online == wasOnline {
+			return nil
+		}
+		syn := u.asSnapshot("offline")
+		if u.Online {
+			syn.Type = "online"
+		}
+		return pass(syn)
+	}
+	done := make(chan struct{})
+	buf := opts.ChannelBuffer
+	if buf < 1 {
+		buf = 1
+	}
+	addrUpd := make(chan netlink.AddrUpdate, buf)
+	routeUpd := make(chan netlink.RouteUpdate, buf)
+	linkUpd := make(chan netlink.LinkUpdate, buf)
+
+	defer close(done)
+
+	var ns *netns.NsHandle
+	m.h = &netlink.Handle{}
+	if opts.Netns != "" {
+		h, err := netns.GetFromPath(opts.Netns)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		ns = &h
+		if m.h, err = netlink.NewHandleAt(h); err != nil {
+			return err
+		}
+		defer m.h.Close()
+	}
+
+	// a nil channel is never selected, disabled subscriptions leave
+	// theirs unset
+	if !opts.WatchAddr {
+		addrUpd = nil
+	} else if err := m.subscribe("address", func(force bool) error {
+		return netlink.AddrSubscribeWithOptions(addrUpd, done, netlink.AddrSubscribeOptions{
+			Namespace:              ns,
+			ReceiveBufferSize:      opts.RecvBufferSize,
+			ReceiveBufferForceSize: force,
+		})
+	}); err != nil {
+		return err
+	}
+	if !opts.WatchRoute {
+		routeUpd = nil
+	} else if err := m.subscribe("route", func(force bool) error {
+		return netlink.RouteSubscribeWithOptions(routeUpd, done, netlink.RouteSubscribeOptions{
+			Namespace:              ns,
+			ReceiveBufferSize:      opts.RecvBufferSize,
+			ReceiveBufferForceSize: force,
+		})
+	}); err != nil {
+		return err
+	}
+	if !opts.WatchLink {
+		linkUpd = nil
+	} else if err := m.subscribe("link", func(force bool) error {
+		return netlink.LinkSubscribeWithOptions(linkUpd, done, netlink.LinkSubscribeOptions{
+			Namespace:              ns,
+			ReceiveBufferSize:      opts.RecvBufferSize,
+			ReceiveBufferForceSize: force,
+		})
+	}); err != nil {
+		return err
+	}
+	var neighUpd chan netlink.NeighUpdate
+	var neighs map[string]string
+	gwMACs := gatewayMACs{}
+	if opts.WatchNeigh {
+		neighUpd = make(chan netlink.NeighUpdate, buf)
+		if err := m.subscribe("neighbor", func(force bool) error {
+			return netlink.NeighSubscribeWithOptions(neighUpd, done, netlink.NeighSubscribeOptions{
+				Namespace:              ns,
+				ReceiveBufferSize:      opts.RecvBufferSize,
+				ReceiveBufferForceSize: force,
+			})
+		}); err != nil {
+			return err
+		}
+		neighs = m.listNeigh()
+	}
+	var ruleUpd chan uint16
+	if opts.WatchRules {
+		ruleUpd = make(chan uint16, buf)
+		if err := ruleSubscribe(ns, ruleUpd, done, m.logf); err != nil {
+			return err
+		}
+	}
+
+	lastUpdate, err := m.initialSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	// links seen in the initial snapshot or in link events, a snapshot
+	// taken for an event may already include links whose events are
+	// still queued
+	knownLinks := map[int]string{}
+	for i, n := range lastUpdate.linkNames {
+		knownLinks[i] = n
+	}
+	states := map[int]linkState{}
+	for _, inf := range lastUpdate.Interfaces {
+		states[inf.Index] = linkState{protoDown: inf.ProtoDown, mac: inf.MAC}
+	}
+	lastUpdate.Type = "init"
+	online = lastUpdate.Online
+	if opts.Started != nil {
+		opts.Started()
+	}
+	if settling {
+		settleTmr.Reset(opts.StartupSettle)
+	}
+	if !opts.SkipInitial {
+		if err := emit(lastUpdate); err != nil {
+			return err
+		}
+	}
+
+	// the interval timer is rearmed after every tick and change, with
+	// IntervalJitter each period is randomized to spread out hosts started
+	// at the same time
+	tmr := newStoppedTimer()
+	defer tmr.Stop()
+	resetInterval := func() {
+		if opts.Interval <= 0 {
+			return
+		}
+		d := opts.Interval
+		if j := opts.IntervalJitter; j > 0 {
+			d += time.Duration(rand.Int63n(2*int64(j)+1)) - j
+		}
+		if d <= 0 {
+			d = time.Millisecond
+		}
+		stopTimer(tmr)
+		tmr.Reset(d)
+	}
+	resetInterval()
+
+	lftTmr := newStoppedTimer()
+	defer lftTmr.Stop()
+	var lftLink string
+	var lftAddr *Address
+	scheduleLifetime := func(u *Update) {
+		if opts.LifetimeWarning <= 0 {
+			return
+		}
+		stopTimer(lftTmr)
+		var d time.Duration
+		lftLink, lftAddr, d = u.nextExpiry(opts.LifetimeWarning)
+		if lftAddr != nil {
+			lftTmr.Reset(d)
+		}
+	}
+	scheduleLifetime(lastUpdate)
+
+	// address deletions are held back for RefreshWindow to see if the same
+	// address is added again
+	pending := map[string]pendingAddr{}
+	// prefix lengths of recently removed addresses, to tell an address
+	// added back with another prefix length from a new one
+	removed := removedAddrs{}
+	// metrics of recently removed and added default routes, to tell a
+	// metric change from a new or removed backup route
+	removedDefaults, addedDefaults := recentRoutes{}, recentRoutes{}
+	pendTmr := newStoppedTimer()
+	defer pendTmr.Stop()
+	schedulePending := func() {
+		stopTimer(pendTmr)
+		var first time.Time
+		for _, p := range pending {
+			if first.IsZero() || p.deadline.Before(first) {
+				first = p.deadline
+			}
+		}
+		if !first.IsZero() {
+			pendTmr.Reset(time.Until(first))
+		}
+	}
+
+	// a netlink socket can wedge without being closed, the stall timer is
+	// reset on every event and interval tick
+	stallTmr := newStoppedTimer()
+	defer stallTmr.Stop()
+	alive := func() {
+		if opts.StallTimeout > 0 {
+			stopTimer(stallTmr)
+			stallTmr.Reset(opts.StallTimeout)
+		}
 	}
-	if u.Source != "" {
-		env = append(env, fmt.Sprintf("IPMON_SRC=%s", u.Source))
+	alive()
+
+	// a failed snapshot would look like a host without interfaces, the
+	// event is dropped instead and the previous state kept
+	snapshot := func(last *Update) bool {
+		u, err := m.genUpdate(last)
+		if err != nil {
+			m.logf("skipping update: %v", err)
+			return false
+		}
+		lastUpdate = u
+		return true
 	}
 
-	for n, inf := range u.Interfaces {
-		for _, a := range inf.Addr {
-			ip := net.ParseIP(a.Address)
-			if ip.IsLinkLocalUnicast() {
-				if ip.To4() != nil {
-					env = append(env, fmt.Sprintf("IPMON_LL_IPV4_%s=%s", n, a.Address))
-				} else if ip.To16() != nil {
-					env = append(env, fmt.Sprintf("IPMON_LL_IPV6_%s=%s", n, a.Address))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-stallTmr.C:
+			m.logf("no events for %s, resyncing", opts.StallTimeout)
+			if !snapshot(nil) {
+				alive()
+				continue
+			}
+			lastUpdate.Type = "resync"
+			if err := emit(lastUpdate); err != nil {
+				return err
+			}
+			scheduleLifetime(lastUpdate)
+			alive()
+		case <-lftTmr.C:
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			lastUpdate.Type = "lifetime"
+			lastUpdate.Link = lftLink
+			lastUpdate.setChanged()
+			lastUpdate.Address = lftAddr
+			lastUpdate.Change = []string{"expiring"}
+			if err := emit(lastUpdate); err != nil {
+				return err
+			}
+			scheduleLifetime(lastUpdate)
+		case <-settleTmr.C:
+			if err := settle(lastUpdate); err != nil {
+				return err
+			}
+		case <-flapTmr.C:
+			if countFlap() > opts.FlapThreshold {
+				flapTmr.Reset(flapWindow)
+				continue
+			}
+			flapping = false
+			flapEvents = nil
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			lastUpdate.Type = "stable"
+			lastPrimary = lastUpdate.primary()
+			lastEmit = time.Now()
+			if err := deliver(lastUpdate); err != nil {
+				return err
+			}
+			scheduleLifetime(lastUpdate)
+		case <-rateTmr.C:
+			u := held
+			held = nil
+			lastEmit = time.Now()
+			if err := deliver(u); err != nil {
+				return err
+			}
+		case <-pendTmr.C:
+			now := time.Now()
+			for key, p := range pending {
+				if p.deadline.After(now) {
+					continue
+				}
+				delete(pending, key)
+				if !snapshot(lastUpdate) {
+					continue
+				}
+				scheduleLifetime(lastUpdate)
+				if opts.IncludeRaw {
+					lastUpdate.Raw = rawAddr(p.update)
+				}
+				if lastUpdate.addrUpdate(p.update) {
+					if err := emit(lastUpdate); err != nil {
+						return err
+					}
 				}
 			}
-
-			if !ip.IsGlobalUnicast() {
+			schedulePending()
+		case a, op := <-addrUpd:
+			if !op {
+				return nil
+			}
+			alive()
+			if !m.wantAddr(a.LinkAddress.IP, a.Scope) || !m.wantLinkIndex(lastUpdate, a.LinkIndex) {
 				continue
 			}
-			if ip.To4() != nil {
-				if a.TTL > 0 {
-					env = append(env, fmt.Sprintf("IPMON_IPV4_TTL_%s=%d", n, a.TTL))
+			prefixChange := false
+			var rotated *Address
+			if a.NewAddr {
+				prefixChange = prefixChanged(lastUpdate, a, removed)
+				rotated = tempRotated(lastUpdate, a)
+			} else {
+				removed.add(a)
+			}
+			if opts.RefreshWindow > 0 {
+				key := fmt.Sprintf("%d %s", a.LinkIndex, a.LinkAddress.String())
+				if !a.NewAddr {
+					pending[key] = pendingAddr{update: a, deadline: time.Now().Add(opts.RefreshWindow)}
+					schedulePending()
+					continue
 				}
-				env = append(env, fmt.Sprintf("IPMON_IPV4_%s=%s", n, a.Address))
-				env = append(env, fmt.Sprintf("IPMON_IPV4_MASK_%s=%d", n, a.CIDR))
-			} else if ip.To16() != nil {
-				if ip.IsPrivate() {
+				if _, ok := pending[key]; ok {
+					delete(pending, key)
+					schedulePending()
+					if !snapshot(lastUpdate) {
+						continue
+					}
+					scheduleLifetime(lastUpdate)
+					if opts.IncludeRaw {
+						lastUpdate.Raw = rawAddr(a)
+					}
+					lastUpdate.addrUpdate(a)
+					lastUpdate.Change = []string{"refresh"}
+					if err := emit(lastUpdate); err != nil {
+						return err
+					}
 					continue
 				}
-				if a.TTL > 0 {
-					env = append(env, fmt.Sprintf("IPMON_IPV6_TTL_%s=%d", n, a.TTL))
+			}
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			if opts.IncludeRaw {
+				lastUpdate.Raw = rawAddr(a)
+			}
+			if lastUpdate.addrUpdate(a) {
+				if prefixChange {
+					lastUpdate.Change = []string{"prefix_change"}
+				}
+				if rotated != nil {
+					lastUpdate.Type = "temp_addr_rotate"
+					lastUpdate.OldAddress = rotated.clone()
+				}
+				if err := emit(lastUpdate); err != nil {
+					return err
+				}
+				resetInterval()
+			}
+		case l, op := <-linkUpd:
+			if !op {
+				return nil
+			}
+			alive()
+			if l.Attrs() == nil || !m.wantLink(l.Attrs().Name) {
+				continue
+			}
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			if opts.IncludeRaw {
+				lastUpdate.Raw = rawLink(l)
+			}
+			changed := lastUpdate.linkUpdate(l, knownLinks, states)
+			if l.Header.Type == unix.RTM_DELLINK {
+				delete(knownLinks, int(l.Index))
+				delete(states, int(l.Index))
+			} else {
+				knownLinks[int(l.Index)] = l.Attrs().Name
+			}
+			if changed {
+				if err := emit(lastUpdate); err != nil {
+					return err
+				}
+				resetInterval()
+			}
+		case r, op := <-routeUpd:
+			if !op {
+				return nil
+			}
+			alive()
+			if !m.wantProtocol(r.Protocol) || !m.wantRoute(r.Route) || !m.wantLinkIndex(lastUpdate, r.LinkIndex) {
+				continue
+			}
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			if opts.IncludeRaw {
+				lastUpdate.Raw = rawRoute(r)
+			}
+			if lastUpdate.routeUpdate(r) {
+				if isDefault(r.Dst) {
+					if old, metric, ok := metricChanged(r, lastUpdate, removedDefaults, addedDefaults); ok {
+						lastUpdate.Change = []string{"metric_change"}
+						lastUpdate.Metric = metric
+						lastUpdate.OldMetric = old
+					}
+				}
+				m.watchedRoute(lastUpdate, r.Route)
+				if err := emit(lastUpdate); err != nil {
+					return err
+				}
+				resetInterval()
+			}
+		case n, op := <-neighUpd:
+			if !op {
+				return nil
+			}
+			alive()
+			if !m.wantLinkIndex(lastUpdate, n.LinkIndex) {
+				continue
+			}
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			gwMACs.track(lastUpdate, neighs)
+			if lastUpdate.neighUpdate(n, neighs) {
+				if old, ok := gwMACs.changed(lastUpdate, neighKey(&n.Neigh), neighs); ok {
+					lastUpdate.Change = []string{"gw_mac_change"}
+					lastUpdate.MAC = neighs[neighKey(&n.Neigh)]
+					lastUpdate.OldMAC = old
+				}
+				if err := emit(lastUpdate); err != nil {
+					return err
 				}
-				env = append(env, fmt.Sprintf("IPMON_IPV6_%s=%s", n, a.Address))
-				env = append(env, fmt.Sprintf("IPMON_IPV6_MASK_%s=%d", n, a.CIDR))
+				resetInterval()
+			}
+		case t, op := <-ruleUpd:
+			if !op {
+				return nil
+			}
+			alive()
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			if opts.IncludeRaw {
+				lastUpdate.Raw = &Raw{Type: msgTypeName(t)}
+			}
+			lastUpdate.Type = "rule"
+			if t == unix.RTM_NEWRULE {
+				lastUpdate.Change = []string{"add"}
+			} else {
+				lastUpdate.Change = []string{"delete"}
+			}
+			if err := emit(lastUpdate); err != nil {
+				return err
+			}
+			resetInterval()
+		case <-tmr.C:
+			resetInterval()
+			alive()
+			if !snapshot(lastUpdate) {
+				continue
+			}
+			scheduleLifetime(lastUpdate)
+			lastUpdate.Type = "interval"
+			if opts.IncludeStats {
+				lastUpdate.setStats()
+			}
+			if err := emit(lastUpdate); err != nil {
+				return err
 			}
 		}
+	}
+}
 
-		if inf.Up {
-			env = append(env, fmt.Sprintf("IPMON_UP_%s=1", n))
-		} else {
-			env = append(env, fmt.Sprintf("IPMON_UP_%s=0", n))
+// setStats sets the counters of every interface from the link of the
+// snapshot
+func (u *Update) setStats() {
+	for _, inf := range u.Interfaces {
+		if inf.link == nil || inf.link.Attrs().Statistics == nil {
+			continue
+		}
+		st := inf.link.Attrs().Statistics
+		inf.Stats = &Stats{
+			RxBytes:  st.RxBytes,
+			TxBytes:  st.TxBytes,
+			RxErrors: st.RxErrors,
+			TxErrors: st.TxErrors,
 		}
+	}
+}
 
+// nextExpiry finds the address with the shortest finite valid lifetime
+// that is still more than window away and returns the time until it is
+// within window
+func (u *Update) nextExpiry(window time.Duration) (link string, addr *Address, d time.Duration) {
+	for _, n := range u.interfaceNames() {
+		for _, a := range u.Interfaces[n].Addr {
+			if a.TTL <= 0 || uint32(a.TTL) == math.MaxUint32 {
+				continue
+			}
+			left := time.Duration(a.TTL)*time.Second - window
+			if left <= 0 {
+				continue
+			}
+			if addr == nil || left < d {
+				link, addr, d = n, a, left
+			}
+		}
 	}
-	if u.Link != "" {
-		env = append(env, fmt.Sprintf("IPMON_LINK=%s", u.Link))
+	return
+}
+
+// ParseScope returns the address scope for a name as used by ip(8)
+func ParseScope(name string) (netlink.Scope, error) {
+	switch name {
+	case "universe", "global":
+		return netlink.SCOPE_UNIVERSE, nil
+	case "site":
+		return netlink.SCOPE_SITE, nil
+	case "link":
+		return netlink.SCOPE_LINK, nil
+	case "host":
+		return netlink.SCOPE_HOST, nil
+	case "nowhere":
+		return netlink.SCOPE_NOWHERE, nil
 	}
+	return 0, fmt.Errorf("unknown scope %q", name)
+}
 
-	var defRouteIPv4 *Route = nil
-	var defRouteIPv6 *Route = nil
+// removedAddrWindow is how long a removed address is remembered for
+// prefixChanged
+const removedAddrWindow = time.Minute
 
-	for _, r := range u.Routes {
-		if r.route.Dst == nil {
-			switch r.route.Protocol {
-			case 4:
-				if defRouteIPv4 == nil || r.route.Priority < defRouteIPv4.route.Priority {
-					defRouteIPv4 = r
-				}
-			case 6:
-				if defRouteIPv6 == nil || r.route.Priority < defRouteIPv6.route.Priority {
-					defRouteIPv6 = r
-				}
-			}
-		} else {
+type removedAddr struct {
+	cidr int
+	at   time.Time
+}
+
+// removedAddrs maps link index and IP of removed addresses to their prefix
+// length
+type removedAddrs map[string]removedAddr
+
+func addrKey(a netlink.AddrUpdate) string {
+	return fmt.Sprintf("%d %s", a.LinkIndex, a.LinkAddress.IP)
+}
 
+// add remembers a removed address and forgets those removed longer than
+// removedAddrWindow ago
+func (r removedAddrs) add(a netlink.AddrUpdate) {
+	now := time.Now()
+	for k, v := range r {
+		if now.Sub(v.at) > removedAddrWindow {
+			delete(r, k)
 		}
 	}
+	cidr, _ := a.LinkAddress.Mask.Size()
+	r[addrKey(a)] = removedAddr{cidr: cidr, at: now}
+}
 
-	if defRouteIPv4 != nil {
-		src := defRouteIPv4.route.Src
-		if src.To4() != nil {
-			env = append(env, fmt.Sprintf("IPMON_IPV4=%s", src.To4().String()))
+// prefixChanged reports whether an added address has the IP of an address
+// on the same link in last, or one removed recently, with another prefix
+// length
+func prefixChanged(last *Update, a netlink.AddrUpdate, removed removedAddrs) bool {
+	cidr, _ := a.LinkAddress.Mask.Size()
+	key := addrKey(a)
+	if r, ok := removed[key]; ok {
+		delete(removed, key)
+		if time.Since(r.at) <= removedAddrWindow && r.cidr != cidr {
+			return true
 		}
-		env = append(env, fmt.Sprintf("IPMON_IPV4_IF=%s", defRouteIPv4.Link))
-		if defRouteIPv4.route.Gw != nil {
-			env = append(env, fmt.Sprintf("IPMON_IPV4_GW=%s", defRouteIPv4.route.Gw.String()))
+	}
+	if inf := last.Interfaces[last.linkNames[a.LinkIndex]]; inf != nil {
+		for _, addr := range inf.Addr {
+			if addr.Address == a.LinkAddress.IP.String() && addr.CIDR != cidr {
+				return true
+			}
 		}
 	}
-	if defRouteIPv6 != nil {
-		src := defRouteIPv6.route.Src
-		if src.To16() != nil {
-			env = append(env, fmt.Sprintf("IPMON_IPV6=%s", src.To16().String()))
+	return false
+}
+
+// tempRotated returns the temporary address that an added temporary IPv6
+// address a replaces, the newest temporary address in last on the same
+// interface and prefix. It returns nil for other addresses and for
+// addresses already in last, e.g. when their lifetime is updated.
+func tempRotated(last *Update, a netlink.AddrUpdate) *Address {
+	if a.LinkAddress.IP.To4() != nil || a.Flags&unix.IFA_F_TEMPORARY == 0 {
+		return nil
+	}
+	inf := last.Interfaces[last.linkNames[a.LinkIndex]]
+	if inf == nil {
+		return nil
+	}
+	prefix := net.IPNet{IP: a.LinkAddress.IP.Mask(a.LinkAddress.Mask), Mask: a.LinkAddress.Mask}
+	var old *Address
+	for _, x := range inf.Addr {
+		if x.Address == a.LinkAddress.IP.String() {
+			return nil
 		}
-		env = append(env, fmt.Sprintf("IPMON_IPV6_IF=%s", defRouteIPv6.Link))
-		if defRouteIPv6.route.Gw != nil {
-			env = append(env, fmt.Sprintf("IPMON_IPV6_GW=%s", defRouteIPv6.route.Gw.String()))
+		if !x.Temporary || x.Stale || !prefix.Contains(net.ParseIP(x.Address)) {
+			continue
+		}
+		if old == nil || x.Pref > old.Pref {
+			old = x
 		}
 	}
+	return old
+}
 
-	sort.Strings(env)
-	return env
+type pendingAddr struct {
+	update   netlink.AddrUpdate
+	deadline time.Time
 }
 
-func Monitor(ctx context.Context, interval int, fn func(*Update)) error {
-	if ctx == nil {
-		ctx = context.Background()
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(0)
+	if !t.Stop() {
+		<-t.C
 	}
-	done := make(chan struct{})
-	addrUpd := make(chan netlink.AddrUpdate, 1)
-	routeUpd := make(chan netlink.RouteUpdate, 1)
-	linkUpd := make(chan netlink.LinkUpdate, 1)
-	//neighUpd := make(chan netlink.NeighUpdate, 1)
+	return t
+}
 
-	defer close(done)
+// stopTimer stops t and drains its channel so that it can be reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
 
-	/* TODO
-	if err := netlink.NeighSubscribeWithOptions(neighUpd, done, netlink.NeighSubscribeOptions{
-		ListExisting: true,
-	}); err != nil {
-		return err
-	}*/
-	if err := netlink.AddrSubscribe(addrUpd, done); err != nil {
-		return err
+type monitor struct {
+	opts MonitorOptions
+	h    *netlink.Handle
+	// tables maps route table ids to names from rt_tables
+	tables map[int]string
+}
+
+func (m *monitor) logf(format string, args ...any) {
+	if m.opts.Logf != nil {
+		m.opts.Logf(format, args...)
+	} else {
+		Debug.Printf(format, args...)
 	}
-	if err := netlink.RouteSubscribe(routeUpd, done); err != nil {
-		return err
+}
+
+// subscribe calls sub with ForceRecvBuffer. SO_RCVBUFFORCE requires
+// CAP_NET_ADMIN, when it is not permitted sub is called again without it
+// and the buffer is capped at net.core.rmem_max.
+func (m *monitor) subscribe(name string, sub func(force bool) error) error {
+	err := sub(m.opts.ForceRecvBuffer && m.opts.RecvBufferSize > 0)
+	if err != nil && m.opts.ForceRecvBuffer && errors.Is(err, unix.EPERM) {
+		m.logf("%s subscription: SO_RCVBUFFORCE not permitted, grant CAP_NET_ADMIN or raise net.core.rmem_max to %d, the buffer is capped at rmem_max", name, m.opts.RecvBufferSize)
+		err = sub(false)
 	}
-	if err := netlink.LinkSubscribe(linkUpd, done); err != nil {
-		return err
+	return err
+}
+
+// wantLink reports whether the interface name is monitored
+func (m *monitor) wantLink(name string) bool {
+	if len(m.opts.Interfaces) == 0 {
+		return true
+	}
+	for _, n := range m.opts.Interfaces {
+		if n == name {
+			return true
+		}
 	}
+	return false
+}
 
-	lastUpdate := genUpdate(nil)
-	lastUpdate.Type = "init"
-	fn(lastUpdate)
+// wantLinkIndex reports whether events for the interface index trigger
+// updates, snapshots only know the names of monitored interfaces
+func (m *monitor) wantLinkIndex(u *Update, index int) bool {
+	if len(m.opts.Interfaces) == 0 {
+		return true
+	}
+	_, ok := u.linkNames[index]
+	return ok
+}
 
-	var tmrCh <-chan time.Time = make(chan time.Time)
-	var tmr *time.Ticker
+// wantAddr reports whether ip is included in snapshots and triggers updates
+func (m *monitor) wantAddr(ip net.IP, scope int) bool {
+	if len(m.opts.Scopes) > 0 {
+		for _, s := range m.opts.Scopes {
+			if int(s) == scope {
+				return true
+			}
+		}
+		return false
+	}
+	if ip.IsLinkLocalUnicast() {
+		return m.opts.IncludeLinkLocal
+	}
+	return ip.IsGlobalUnicast()
+}
 
-	if interval > 0 {
-		tmr = time.NewTicker(time.Duration(interval) * time.Second)
-		tmrCh = tmr.C
-		defer tmr.Stop()
+// wantRoute reports whether changes to r trigger updates
+func (m *monitor) wantRoute(r netlink.Route) bool {
+	if isDefault(r.Dst) {
+		return true
+	}
+	if m.opts.RequireGateway && r.Gw == nil && len(r.MultiPath) == 0 {
+		return false
+	}
+	if len(m.opts.WatchDestinations) == 0 {
+		return true
+	}
+	ones, _ := r.Dst.Mask.Size()
+	for _, n := range m.opts.WatchDestinations {
+		prefix, _ := n.Mask.Size()
+		if n.Contains(r.Dst.IP) && ones >= prefix {
+			return true
+		}
 	}
+	return false
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case a, op := <-addrUpd:
-			if !op {
-				return nil
-			}
-			lastUpdate = genUpdate(lastUpdate)
-			if lastUpdate.addrUpdate(a) {
-				fn(lastUpdate)
-				if tmr != nil {
-					tmr.Reset(time.Duration(interval) * time.Second)
-				}
-			}
-		case l, op := <-linkUpd:
-			if !op {
-				return nil
-			}
-			lastUpdate = genUpdate(lastUpdate)
-			if lastUpdate.linkUpdate(l) {
-				fn(lastUpdate)
-				if tmr != nil {
-					tmr.Reset(time.Duration(interval) * time.Second)
-				}
-			}
-		case r, op := <-routeUpd:
-			if !op {
-				return nil
-			}
-			lastUpdate = genUpdate(lastUpdate)
-			if lastUpdate.routeUpdate(r) {
-				fn(lastUpdate)
-				if tmr != nil {
-					tmr.Reset(time.Duration(interval) * time.Second)
-				}
-			}
-		case <-tmrCh:
-			lastUpdate := genUpdate(nil)
-			lastUpdate.Type = "interval"
-			fn(lastUpdate)
+// watchedRoute sets WatchedRoute of u when the route event for r added or
+// removed a route to one of the prefixes in WatchRoutes
+func (m *monitor) watchedRoute(u *Update, r netlink.Route) {
+	if isDefault(r.Dst) || len(u.Change) != 1 {
+		return
+	}
+	state := ""
+	switch u.Change[0] {
+	case "add":
+		state = "up"
+	case "delete":
+		state = "down"
+	default:
+		return
+	}
+	ones, bits := r.Dst.Mask.Size()
+	for _, n := range m.opts.WatchRoutes {
+		prefix, size := n.Mask.Size()
+		if prefix == ones && size == bits && n.IP.Equal(r.Dst.IP) {
+			u.WatchedRoute = n.String()
+			u.WatchedRouteState = state
+			return
 		}
 	}
 }
 
-func genUpdate(last *Update) *Update {
+// delegatedPrefix reports whether r looks like the route a DHCPv6-PD
+// client installs for a delegated prefix, usually an unreachable route
+// covering the whole prefix which is shorter than a single /64 subnet
+func delegatedPrefix(r netlink.Route) bool {
+	if r.Family != netlink.FAMILY_V6 || r.Dst == nil {
+		return false
+	}
+	if r.Protocol != unix.RTPROT_DHCP && r.Protocol != unix.RTPROT_RA {
+		return false
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones > 0 && ones < 64
+}
+
+// initialSnapshot takes the first snapshot and returns the error of ctx
+// when it is done before the snapshot completes. Netlink requests cannot be
+// interrupted, an abandoned snapshot finishes in the background.
+func (m *monitor) initialSnapshot(ctx context.Context) (*Update, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		u   *Update
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		u, err := m.genUpdate(nil)
+		res <- result{u, err}
+	}()
+	select {
+	case r := <-res:
+		return r.u, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// genUpdate takes a snapshot of links, addresses and routes. Failing to
+// list links or routes is an error since the result would be empty.
+func (m *monitor) genUpdate(last *Update) (*Update, error) {
 	upd := &Update{
+		Timestamp:  time.Now(),
 		Interfaces: map[string]*Interface{},
 	}
 
 	lnkIdx := map[int]string{}
+	var groups map[int][]*Address
+	if (m.opts.IncludeAnycast || m.opts.IncludeMulticast) && m.opts.Netns == "" {
+		groups = m.groupAddrs()
+	}
+	upd.linkNames = lnkIdx
 
-	links, _ := netlink.LinkList()
+	links, err := m.h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("LinkList: %w", err)
+	}
+	index := func(l netlink.Link) int {
+		if l == nil || l.Attrs() == nil {
+			return -1
+		}
+		return l.Attrs().Index
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return index(links[i]) < index(links[j])
+	})
 	for _, link := range links {
-		if link == nil || link.Attrs() == nil {
+		if link == nil || link.Attrs() == nil || !m.wantLink(link.Attrs().Name) {
 			continue
 		}
 		lnkIdx[link.Attrs().Index] = link.Attrs().Name
 		inf := &Interface{
-			link: link,
-			Up:   (link.Attrs().Flags & unix.IFF_UP) == unix.IFF_UP,
+			link:  link,
+			Index: link.Attrs().Index,
+			Kind:  link.Type(),
+			Up:    (link.Attrs().Flags & unix.IFF_UP) == unix.IFF_UP,
+			// net.Flags has no IFF_LOWER_UP
+			Carrier: link.Attrs().RawFlags&unix.IFF_LOWER_UP != 0,
+		}
+		if len(link.Attrs().PermHWAddr) > 0 {
+			inf.PermAddr = link.Attrs().PermHWAddr.String()
+		}
+		if len(link.Attrs().HardwareAddr) > 0 {
+			inf.MAC = link.Attrs().HardwareAddr.String()
+		}
+		if m.opts.Netns == "" {
+			inf.Managed = linkManager(inf.Index)
+			inf.ProtoDown = linkProtoDown(link.Attrs().Name)
+			// wgctrl queries the current namespace, not m.h
+			if link.Type() == "wireguard" && m.opts.WireGuardInfo != nil {
+				wg, err := m.opts.WireGuardInfo(link.Attrs().Name)
+				if err != nil {
+					m.logf("WireGuardInfo %s: %v", link.Attrs().Name, err)
+				}
+				inf.WireGuard = wg
+			}
+		}
+		addrs, err := m.h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			m.logf("AddrList %s: %v", link.Attrs().Name, err)
+			if _, err := m.h.LinkByIndex(link.Attrs().Index); err != nil {
+				// the link was removed after LinkList, leave it out
+				// rather than reporting it without addresses
+				delete(lnkIdx, link.Attrs().Index)
+				continue
+			}
+			upd.Partial = true
 		}
-		addrs, _ := netlink.AddrList(link, netlink.FAMILY_ALL)
 
 		for _, addr := range addrs {
-			if !addr.IP.IsGlobalUnicast() && !addr.IP.IsLinkLocalUnicast() {
+			if !m.wantAddr(addr.IP, addr.Scope) {
 				continue
 			}
 			cidr, _ := addr.Mask.Size()
 			inf.Addr = append(inf.Addr, &Address{
-				Address: addr.IP.String(),
-				CIDR:    cidr,
-				TTL:     addr.ValidLft,
-				N:       addr,
+				Address:   addr.IP.String(),
+				CIDR:      cidr,
+				TTL:       addr.ValidLft,
+				Pref:      addr.PreferedLft,
+				N:         addr,
+				Temporary: addr.IP.To4() == nil && addr.Flags&unix.IFA_F_TEMPORARY != 0,
+				Origin:    addrOrigin(addr.Flags),
+				Label:     addr.Label,
 			})
 		}
+		inf.Addr = append(inf.Addr, groups[inf.Index]...)
+		if m.opts.RetainStaleAddrs && !inf.Up && last != nil {
+			inf.retainStale(last.Interfaces[link.Attrs().Name])
+		}
 		upd.Interfaces[link.Attrs().Name] = inf
+		upd.order = append(upd.order, link.Attrs().Name)
 	}
 
-	routes, _ := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	routes, err := m.h.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("RouteList: %w", err)
+	}
 	for _, route := range routes {
 
 		if route.Scope != netlink.SCOPE_UNIVERSE && route.Scope != netlink.SCOPE_LINK {
@@ -285,11 +2061,21 @@ func genUpdate(last *Update) *Update {
 		if route.Table != 254 {
 			continue
 		}
+		if delegatedPrefix(route) {
+			upd.DelegatedPrefixes = append(upd.DelegatedPrefixes, route.Dst.String())
+		}
+		if !m.wantProtocol(route.Protocol) {
+			continue
+		}
+		if _, ok := lnkIdx[route.LinkIndex]; route.LinkIndex > 0 && !ok {
+			// route of a link that was removed during the snapshot
+			continue
+		}
 
 		dst := "default"
 		gw := ""
 		src := ""
-		if route.Dst != nil {
+		if !isDefault(route.Dst) {
 			dst = route.Dst.String()
 		}
 		if route.Gw != nil {
@@ -305,25 +2091,53 @@ func genUpdate(last *Update) *Update {
 			Gateway:     gw,
 			Src:         src,
 			Link:        lnkIdx[route.LinkIndex],
+			LinkIndex:   route.LinkIndex,
+			Table:       route.Table,
+			TableName:   tableName(m.tables, route.Table),
+			Metric:      route.Priority,
 		})
 	}
 
-	return upd
+	sort.Strings(upd.DelegatedPrefixes)
+	if m.opts.WatchRules {
+		upd.Rules = m.listRules()
+	}
+	if m.opts.WatchNeigh {
+		upd.Neighbors = m.listNeighbors(lnkIdx)
+	}
+
+	v4, v6 := upd.defaultRoutes()
+	upd.Online = v4 != nil || v6 != nil
+
+	return upd, nil
 }
 
 func (u *Update) addrUpdate(a netlink.AddrUpdate) bool {
 	u.Type = "address"
 	cidr, _ := a.LinkAddress.Mask.Size()
+	ipNet := a.LinkAddress
 	u.Address = &Address{
 		Address: a.LinkAddress.IP.String(),
 		CIDR:    cidr,
 		TTL:     a.ValidLft,
+		Pref:    a.PreferedLft,
+		N: netlink.Addr{
+			IPNet:       &ipNet,
+			Flags:       a.Flags,
+			Scope:       a.Scope,
+			PreferedLft: a.PreferedLft,
+			ValidLft:    a.ValidLft,
+		},
+		Temporary: a.LinkAddress.IP.To4() == nil && a.Flags&unix.IFA_F_TEMPORARY != 0,
+		Origin:    addrOrigin(a.Flags),
 	}
-	lnk, _ := netlink.LinkByIndex(a.LinkIndex)
-	if lnk != nil && lnk.Attrs() != nil {
-		u.Link = lnk.Attrs().Name
-	}
-	if a.NewAddr {
+	u.Link = u.linkNames[a.LinkIndex]
+	u.setChanged()
+	if a.NewAddr && a.Flags&unix.IFA_F_DADFAILED != 0 {
+		// duplicate address detection failed, the address is unusable
+		u.Type = "dad_failed"
+		u.Change = []string{"dad_failed"}
+	} else if a.NewAddr {
 		u.Change = []string{"add"}
 	} else {
 		u.Change = []string{"delete"}
@@ -331,10 +2145,34 @@ func (u *Update) addrUpdate(a netlink.AddrUpdate) bool {
 	return true
 }
 
-func (u *Update) linkUpdate(a netlink.LinkUpdate) bool {
+// linkState holds the link properties compared by linkUpdate that are not
+// reported as flag changes
+type linkState struct {
+	protoDown bool
+	mac       string
+}
+
+// linkUpdate describes a link event, known holds the links seen before to
+// tell new links from changed ones and states their last state
+func (u *Update) linkUpdate(a netlink.LinkUpdate, known map[int]string, states map[int]linkState) bool {
 	u.Type = "link"
 	if a.Link != nil && a.Link.Attrs() != nil {
 		u.Link = a.Link.Attrs().Name
+		u.LinkKind = a.Link.Type()
+	}
+	u.setChanged()
+	switch _, ok := known[int(a.Index)]; {
+	case a.Header.Type == unix.RTM_DELLINK:
+		u.Type = "link_removed"
+		u.Change = []string{"removed"}
+		return true
+	case a.Header.Type == unix.RTM_NEWLINK && !ok:
+		u.Type = "link_added"
+		u.Change = []string{"added"}
+		if inf := u.Interfaces[u.Link]; inf != nil {
+			states[int(a.Index)] = linkState{protoDown: inf.ProtoDown, mac: inf.MAC}
+		}
+		return true
 	}
 	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_UP, "up", "down")...)
 	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_PROMISC, "promisc", "nopromisc")...)
@@ -343,15 +2181,38 @@ func (u *Update) linkUpdate(a netlink.LinkUpdate) bool {
 	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_LOOPBACK, "loopback", "noloopback")...)
 	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_POINTOPOINT, "pointtopoint", "nopointtopoint")...)
 	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_MULTICAST, "multicast", "nomulticast")...)
+	u.Change = append(u.Change, testFlag(a.Change, a.Flags, unix.IFF_LOWER_UP, "carrier", "nocarrier")...)
 
-	if a.Change&unix.IFF_UP == 0 {
-		return false
+	// protodown and the MAC address are not flags, compare them to the
+	// last known state using the snapshot taken for this event
+	changed := false
+	st := states[int(a.Index)]
+	if inf := u.Interfaces[u.Link]; inf != nil {
+		if inf.ProtoDown != st.protoDown {
+			if inf.ProtoDown {
+				u.Change = append(u.Change, "protodown")
+			} else {
+				u.Change = append(u.Change, "noprotodown")
+			}
+			changed = true
+		}
+		if inf.MAC != st.mac && st.mac != "" && inf.MAC != "" {
+			u.Change = append(u.Change, "mac_change")
+			u.MAC = inf.MAC
+			u.OldMAC = st.mac
+			changed = true
+		}
+		states[int(a.Index)] = linkState{protoDown: inf.ProtoDown, mac: inf.MAC}
 	}
-	return true
+
+	// Only transitions of IFF_UP, protodown and MAC address changes
+	// trigger an update, this covers both directions since testFlag labels
+	// a cleared flag as "down"
+	return a.Change&unix.IFF_UP != 0 || changed
 }
 func (u *Update) routeUpdate(a netlink.RouteUpdate) bool {
 	u.Type = "route"
-	if a.Dst != nil {
+	if !isDefault(a.Dst) {
 		cidr, _ := a.Dst.Mask.Size()
 		u.Address = &Address{
 			Address: a.Dst.IP.String(),
@@ -366,11 +2227,18 @@ func (u *Update) routeUpdate(a netlink.RouteUpdate) bool {
 	if a.Src != nil {
 		u.Source = a.Src.String()
 	}
-	lnk, _ := netlink.LinkByIndex(a.ILinkIndex)
-	if lnk != nil && lnk.Attrs() != nil {
-		u.Link = lnk.Attrs().Name
+	u.Link = u.linkNames[a.LinkIndex]
+	u.Metric = a.Priority
+	u.setChanged()
+	for _, nh := range a.MultiPath {
+		if name := u.linkNames[nh.LinkIndex]; name != "" && name != u.Link {
+			u.ChangedInterfaces = append(u.ChangedInterfaces, name)
+		}
 	}
-	if a.Type == unix.RTM_NEWROUTE {
+	if a.Type == unix.RTM_NEWROUTE && a.NlFlags&unix.NLM_F_REPLACE != 0 {
+		// an existing route changed, e.g. its gateway or metric
+		u.Change = []string{"replace"}
+	} else if a.Type == unix.RTM_NEWROUTE {
 		u.Change = []string{"add"}
 	} else if a.Type == unix.RTM_DELROUTE {
 		u.Change = []string{"delete"}
@@ -384,6 +2252,36 @@ func (u *Update) routeUpdate(a netlink.RouteUpdate) bool {
 	return true
 }
 
+// asSnapshot returns a copy of u with type typ and without the fields
+// describing an event
+func (u *Update) asSnapshot(typ string) *Update {
+	c := *u
+	c.Type = typ
+	c.Change = nil
+	c.Link = ""
+	c.LinkKind = ""
+	c.Address = nil
+	c.Gateway = ""
+	c.Source = ""
+	c.Raw = nil
+	c.ChangedInterfaces = nil
+	c.MAC = ""
+	c.OldMAC = ""
+	c.Metric = 0
+	c.OldMetric = 0
+	c.WatchedRoute = ""
+	c.WatchedRouteState = ""
+	c.OldAddress = nil
+	return &c
+}
+
+// setChanged sets ChangedInterfaces to Link
+func (u *Update) setChanged() {
+	if u.Link != "" {
+		u.ChangedInterfaces = []string{u.Link}
+	}
+}
+
 func testFlag(a, b, c uint32, add, delete string) []string {
 	if a&c == 0 {
 		return nil
@@ -0,0 +1,275 @@
+package ipmon
+
+import (
+	"context"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"eth0", "ETH0"},
+		{"eth0.100", "ETH0_100"},
+		{"wg-home", "WG_HOME"},
+		{"vlan@eth0", "VLAN_ETH0"},
+		{"Br_0", "BR_0"},
+	} {
+		if got := envName(tc.name); got != tc.want {
+			t.Errorf("envName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMarshalEnvInterfaceNames(t *testing.T) {
+	u := &Update{Interfaces: map[string]*Interface{
+		"eth0.100": {Index: 2, Up: true},
+		"wg-home":  {Index: 3, Up: true},
+	}}
+	env := u.MarshalEnvMap()
+	for key, want := range map[string]string{
+		"IPMON_UP_ETH0_100": "1",
+		"IPMON_UP_WG_HOME":  "1",
+		"IPMON_IFACES":      "ETH0_100:eth0.100 WG_HOME:wg-home",
+	} {
+		if got := env[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMarshalEnvListSeparator(t *testing.T) {
+	u := &Update{
+		Change:     []string{"add", "up"},
+		Interfaces: map[string]*Interface{"eth0": {Index: 2}, "eth1": {Index: 3}},
+	}
+	env := u.MarshalEnvMapSep(",")
+	for key, want := range map[string]string{
+		"IPMON_CHANGE": "add,up",
+		"IPMON_IFACES": "ETH0:eth0,ETH1:eth1",
+	} {
+		if got := env[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMarshalEnvShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	const value = "it's a link"
+	u := &Update{Type: "link", Link: value}
+
+	found := false
+	for _, kv := range u.MarshalEnv() {
+		found = found || kv == "IPMON_LINK="+value
+	}
+	if !found {
+		t.Errorf("MarshalEnv does not pass %q as-is", value)
+	}
+
+	script := strings.Join(u.MarshalEnvShell(), "\n") + "\nprintf %s \"$IPMON_LINK\"\n"
+	out, err := exec.Command(sh, "-c", script).Output()
+	if err != nil {
+		t.Fatalf("sh: %v", err)
+	}
+	if string(out) != value {
+		t.Errorf("sourced IPMON_LINK = %q, want %q", out, value)
+	}
+}
+
+// hostAddr returns a permanent address with prefix length cidr
+func hostAddr(addr string, cidr int) *Address {
+	ip := net.ParseIP(addr)
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	return &Address{
+		Address: addr,
+		CIDR:    cidr,
+		N: netlink.Addr{
+			IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(cidr, bits)},
+			Flags: unix.IFA_F_PERMANENT,
+		},
+	}
+}
+
+// TestHostAddressSource checks that /32 and /128 addresses are selected as
+// the default route source, both when they are the route source and when
+// they are the only global address on the egress interface
+func TestHostAddressSource(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		family int
+		src    string
+		addrs  map[string][]*Address
+		key    string
+		want   string
+	}{
+		{
+			name:   "v4 route src on lo",
+			family: netlink.FAMILY_V4,
+			src:    "203.0.113.10",
+			addrs: map[string][]*Address{
+				"eth0": {hostAddr("192.0.2.2", 24)},
+				"lo":   {hostAddr("203.0.113.10", 32)},
+			},
+			key:  "IPMON_IPV4",
+			want: "203.0.113.10",
+		},
+		{
+			name:   "v4 only address",
+			family: netlink.FAMILY_V4,
+			addrs:  map[string][]*Address{"eth0": {hostAddr("203.0.113.10", 32)}},
+			key:    "IPMON_IPV4",
+			want:   "203.0.113.10",
+		},
+		{
+			name:   "v6 route src on lo",
+			family: netlink.FAMILY_V6,
+			src:    "2001:db8::10",
+			addrs: map[string][]*Address{
+				"eth0": {hostAddr("2001:db8:1::2", 64)},
+				"lo":   {hostAddr("2001:db8::10", 128)},
+			},
+			key:  "IPMON_IPV6",
+			want: "2001:db8::10",
+		},
+		{
+			name:   "v6 only address",
+			family: netlink.FAMILY_V6,
+			addrs:  map[string][]*Address{"eth0": {hostAddr("2001:db8::10", 128)}},
+			key:    "IPMON_IPV6",
+			want:   "2001:db8::10",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &Update{Interfaces: map[string]*Interface{}}
+			for name, addrs := range tc.addrs {
+				u.Interfaces[name] = &Interface{Up: true, Addr: addrs}
+			}
+			r := netlink.Route{Family: tc.family, LinkIndex: 2}
+			if tc.src != "" {
+				r.Src = net.ParseIP(tc.src)
+			}
+			u.Routes = []*Route{{route: r, Destination: "default", Link: "eth0", LinkIndex: 2}}
+			if got := u.MarshalEnvMap()[tc.key]; got != tc.want {
+				t.Errorf("%s = %q, want %q", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDefaultRouteFamily selects the default routes by address family,
+// whatever protocol installed them. Earlier versions compared the route
+// protocol against 4 and 6, which took a static IPv6 route for IPv4 and
+// ignored DHCP and boot routes.
+func TestDefaultRouteFamily(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		family   int
+		protocol netlink.RouteProtocol
+		want     map[string]string
+	}{
+		{"v4 dhcp", netlink.FAMILY_V4, unix.RTPROT_DHCP, map[string]string{"IPMON_IPV4": "192.0.2.2", "IPMON_IPV6": ""}},
+		{"v4 boot", netlink.FAMILY_V4, unix.RTPROT_BOOT, map[string]string{"IPMON_IPV4": "192.0.2.2", "IPMON_IPV6": ""}},
+		{"v6 static", netlink.FAMILY_V6, unix.RTPROT_STATIC, map[string]string{"IPMON_IPV4": "", "IPMON_IPV6": "2001:db8::2"}},
+		{"v6 ra", netlink.FAMILY_V6, unix.RTPROT_RA, map[string]string{"IPMON_IPV4": "", "IPMON_IPV6": "2001:db8::2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &Update{Interfaces: map[string]*Interface{
+				"eth0": {Index: 2, Up: true, Addr: []*Address{hostAddr("192.0.2.2", 24), hostAddr("2001:db8::2", 64)}},
+			}}
+			r := netlink.Route{Family: tc.family, LinkIndex: 2, Protocol: tc.protocol}
+			u.Routes = []*Route{{route: r, Destination: "default", Link: "eth0", LinkIndex: 2}}
+			env := u.MarshalEnvMap()
+			for key, want := range tc.want {
+				if got := env[key]; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestMonitorNoWatch expects the zero MonitorOptions, which subscribe to
+// nothing, to be rejected instead of monitoring nothing
+func TestMonitorNoWatch(t *testing.T) {
+	err := MonitorContext(context.Background(), MonitorOptions{Interval: time.Second}, func(context.Context, *Update) error {
+		t.Error("update delivered")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("MonitorContext returned nil")
+	}
+}
+
+// TestIntervalStats expects interface counters on interval updates only
+func TestIntervalStats(t *testing.T) {
+	path, h := testNetns(t)
+	link := testLink(t, h, "ipmon0")
+	opts := DefaultMonitorOptions()
+	opts.IncludeStats = true
+	opts.Interval = 200 * time.Millisecond
+	updates := monitorNetns(t, opts, path)
+	u := waitUpdate(t, updates, func(u *Update) bool { return u.Type == "init" })
+	if u.Interfaces["lo"].Stats != nil {
+		t.Error("init update has stats")
+	}
+	u = waitUpdate(t, updates, func(u *Update) bool { return u.Type == "interval" })
+	if u.Interfaces["lo"].Stats == nil {
+		t.Error("interval update has no stats")
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatalf("LinkSetUp: %v", err)
+	}
+	u = waitUpdate(t, updates, func(u *Update) bool { return u.Type == "link" })
+	if u.Interfaces["lo"].Stats != nil {
+		t.Error("link update has stats")
+	}
+}
+
+// TestOnlineSlim adds and removes the only default route and expects the
+// online and offline updates following the route updates to be slim like
+// other event updates
+func TestOnlineSlim(t *testing.T) {
+	path, h := testNetns(t)
+	link := testLink(t, h, "ipmon0")
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatalf("LinkSetUp: %v", err)
+	}
+	mustAddr(t, h, link, "192.0.2.2/24")
+	opts := DefaultMonitorOptions()
+	opts.FullSnapshotOnEvent = false
+	updates := monitorNetns(t, opts, path)
+	if u := waitUpdate(t, updates, func(u *Update) bool { return u.Type == "init" }); u.Online {
+		t.Fatal("online without a default route")
+	}
+
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("192.0.2.1")}
+	for _, tc := range []struct {
+		typ    string
+		online bool
+		change func() error
+	}{
+		{"online", true, func() error { return h.RouteAdd(route) }},
+		{"offline", false, func() error { return h.RouteDel(route) }},
+	} {
+		if err := tc.change(); err != nil {
+			t.Fatalf("%s: %v", tc.typ, err)
+		}
+		u := waitUpdate(t, updates, func(u *Update) bool { return u.Type == tc.typ })
+		if u.Online != tc.online || u.Interfaces != nil || u.Routes != nil {
+			t.Errorf("%s: online %v, %d interfaces, %d routes, want slim update", tc.typ, u.Online, len(u.Interfaces), len(u.Routes))
+		}
+	}
+}
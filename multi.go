@@ -0,0 +1,41 @@
+package ipmon
+
+import (
+	"context"
+	"sync"
+)
+
+// MonitorMulti monitors several network namespaces concurrently, keyed by
+// a name that is set as Netns on every update passed to fn. Calls to fn are
+// serialized. When fn or one of the monitors returns an error all monitors
+// are stopped and the first error is returned.
+func MonitorMulti(ctx context.Context, namespaces map[string]MonitorOptions, fn func(context.Context, *Update) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	errs := make(chan error, len(namespaces))
+	for name, opts := range namespaces {
+		name, opts := name, opts
+		go func() {
+			errs <- MonitorContext(ctx, opts, func(ctx context.Context, u *Update) error {
+				u.Netns = name
+				mu.Lock()
+				defer mu.Unlock()
+				return fn(ctx, u)
+			})
+		}()
+	}
+
+	var err error
+	for range namespaces {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
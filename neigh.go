@@ -0,0 +1,211 @@
+package ipmon
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sort"
+)
+
+// Neighbor is a resolved entry of the ARP or NDP table
+type Neighbor struct {
+	IP    string `json:"ip"`
+	MAC   string `json:"mac"`
+	Link  string `json:"link"`
+	State string `json:"state"`
+}
+
+func (n *Neighbor) String() string {
+	return fmt.Sprintf("%s lladdr %s dev %s %s", n.IP, n.MAC, n.Link, n.State)
+}
+
+var neighStates = []struct {
+	state int
+	name  string
+}{
+	{unix.NUD_PERMANENT, "permanent"},
+	{unix.NUD_REACHABLE, "reachable"},
+	{unix.NUD_STALE, "stale"},
+	{unix.NUD_DELAY, "delay"},
+	{unix.NUD_PROBE, "probe"},
+}
+
+// neighStateName returns the name ip(8) uses for a usable neighbor state
+func neighStateName(state int) string {
+	for _, s := range neighStates {
+		if state&s.state != 0 {
+			return s.name
+		}
+	}
+	return fmt.Sprintf("%#x", state)
+}
+
+// neighUsable reports whether a neighbor entry has a resolved link layer
+// address, incomplete and failed entries are ignored
+func neighUsable(state int) bool {
+	return state&(unix.NUD_REACHABLE|unix.NUD_STALE|unix.NUD_DELAY|unix.NUD_PROBE|unix.NUD_PERMANENT|unix.NUD_NOARP) != 0
+}
+
+func neighKey(n *netlink.Neigh) string {
+	return fmt.Sprintf("%d %s", n.LinkIndex, n.IP)
+}
+
+// gatewayKeys returns the neighKey of the gateways of the default routes
+// of u
+func (u *Update) gatewayKeys() (keys []string) {
+	v4, v6 := u.defaultRoutes()
+	for _, r := range []*Route{v4, v6} {
+		if r != nil && r.Gateway != "" {
+			keys = append(keys, fmt.Sprintf("%d %s", r.LinkIndex, r.Gateway))
+		}
+	}
+	return keys
+}
+
+// gatewayMAC returns the link layer address of the gateway of r from the
+// neighbor table of u, empty when it is not resolved or not included
+func (u *Update) gatewayMAC(r *Route) string {
+	for _, n := range u.Neighbors {
+		if n.IP == r.Gateway && n.Link == r.Link {
+			return n.MAC
+		}
+	}
+	return ""
+}
+
+// gatewayMACs holds the last link layer address of every default gateway
+// keyed by neighKey. Unlike the known neighbors it is kept when the entry
+// is removed, so a router replaced behind the same IP is noticed when the
+// entry is resolved again.
+type gatewayMACs map[string]string
+
+// track forgets gateways no longer used by the default routes of u and
+// records the address of new ones from known
+func (g gatewayMACs) track(u *Update, known map[string]string) {
+	keys := u.gatewayKeys()
+	for key := range g {
+		found := false
+		for _, k := range keys {
+			found = found || k == key
+		}
+		if !found {
+			delete(g, key)
+		}
+	}
+	for _, key := range keys {
+		if mac := known[key]; mac != "" && g[key] == "" {
+			g[key] = mac
+		}
+	}
+}
+
+// changed records the address in known of the neighbor key when it is a
+// default gateway of u and returns the previous address if it differs
+func (g gatewayMACs) changed(u *Update, key string, known map[string]string) (string, bool) {
+	prev, ok := g[key]
+	mac := known[key]
+	if !ok || mac == "" {
+		return "", false
+	}
+	g[key] = mac
+	return prev, prev != "" && prev != mac
+}
+
+// listNeigh returns the link layer address of every usable neighbor entry
+// keyed by neighKey
+func (m *monitor) listNeigh() map[string]string {
+	known := map[string]string{}
+	list, err := m.h.NeighList(0, netlink.FAMILY_ALL)
+	if err != nil {
+		m.logf("NeighList: %v", err)
+		return known
+	}
+	for i := range list {
+		n := &list[i]
+		if n.IP != nil && len(n.HardwareAddr) > 0 && neighUsable(n.State) {
+			known[neighKey(n)] = n.HardwareAddr.String()
+		}
+	}
+	return known
+}
+
+// neighListed are the states of entries included in snapshots, noarp
+// entries for multicast and loopback addresses are left out
+const neighListed = unix.NUD_REACHABLE | unix.NUD_STALE | unix.NUD_DELAY | unix.NUD_PROBE | unix.NUD_PERMANENT
+
+// listNeighbors returns the neighbor entries of the links in lnkIdx in one
+// of the neighListed states, sorted by link and address
+func (m *monitor) listNeighbors(lnkIdx map[int]string) (neighbors []*Neighbor) {
+	list, err := m.h.NeighList(0, netlink.FAMILY_ALL)
+	if err != nil {
+		m.logf("NeighList: %v", err)
+		return nil
+	}
+	for i := range list {
+		n := &list[i]
+		link, ok := lnkIdx[n.LinkIndex]
+		if !ok || n.IP == nil || len(n.HardwareAddr) == 0 || n.State&neighListed == 0 {
+			continue
+		}
+		neighbors = append(neighbors, &Neighbor{
+			IP:    n.IP.String(),
+			MAC:   n.HardwareAddr.String(),
+			Link:  link,
+			State: neighStateName(n.State),
+		})
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Link != neighbors[j].Link {
+			return neighbors[i].Link < neighbors[j].Link
+		}
+		return neighbors[i].IP < neighbors[j].IP
+	})
+	return neighbors
+}
+
+// neighUpdate updates known with a neighbor event and reports whether it
+// should trigger an update. Only entries becoming usable, changing link
+// layer address or going away do, state transitions between reachable and
+// stale are ignored.
+func (u *Update) neighUpdate(a netlink.NeighUpdate, known map[string]string) bool {
+	if a.IP == nil {
+		return false
+	}
+	key := neighKey(&a.Neigh)
+	prev, ok := known[key]
+	mac := ""
+	if len(a.HardwareAddr) > 0 {
+		mac = a.HardwareAddr.String()
+	}
+
+	u.Type = "neigh"
+	u.Link = u.linkNames[a.LinkIndex]
+	u.setChanged()
+	cidr := 128
+	if a.IP.To4() != nil {
+		cidr = 32
+	}
+	u.Address = &Address{
+		Address: a.IP.String(),
+		CIDR:    cidr,
+	}
+
+	if a.Type == unix.RTM_DELNEIGH || !neighUsable(a.State) || mac == "" {
+		if !ok {
+			return false
+		}
+		delete(known, key)
+		u.Change = []string{"delete"}
+		return true
+	}
+	known[key] = mac
+	switch {
+	case !ok:
+		u.Change = []string{"add"}
+	case prev != mac:
+		u.Change = []string{"lladdr"}
+	default:
+		return false
+	}
+	return true
+}
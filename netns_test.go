@@ -0,0 +1,130 @@
+package ipmon
+
+import (
+	"context"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var netnsCount int32
+
+// testNetns creates a network namespace with lo up that is removed when
+// the test ends and returns its path and a handle to configure it. The
+// test is skipped when namespaces cannot be created, e.g. without root.
+func testNetns(t *testing.T) (string, *netlink.Handle) {
+	t.Helper()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns: %v", err)
+	}
+	defer orig.Close()
+	name := fmt.Sprintf("ipmon-test-%d-%d", os.Getpid(), atomic.AddInt32(&netnsCount, 1))
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		t.Skipf("netns: %v", err)
+	}
+	if err := netns.Set(orig); err != nil {
+		t.Fatalf("restore netns: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ns.Close()
+		_ = netns.DeleteNamed(name)
+	})
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatalf("NewHandleAt: %v", err)
+	}
+	t.Cleanup(h.Close)
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		t.Fatalf("LinkByName: %v", err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		t.Fatalf("LinkSetUp: %v", err)
+	}
+	return filepath.Join("/run/netns", name), h
+}
+
+// mustAddr adds cidr to link through h
+func mustAddr(t *testing.T, h *netlink.Handle, link netlink.Link, cidr string) {
+	t.Helper()
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddrAdd(link, addr); err != nil {
+		t.Fatalf("AddrAdd %s: %v", cidr, err)
+	}
+}
+
+// testLink creates a link that is down, a dummy device or an ifb device
+// when the kernel lacks dummy support, the test is skipped without either
+func testLink(t *testing.T, h *netlink.Handle, name string) netlink.Link {
+	t.Helper()
+	err := h.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	if err != nil {
+		err = h.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	}
+	if err != nil {
+		t.Skipf("LinkAdd: %v", err)
+	}
+	link, err := h.LinkByName(name)
+	if err != nil {
+		t.Fatalf("LinkByName: %v", err)
+	}
+	return link
+}
+
+// monitorNetns runs MonitorContext in the namespace at path and returns a
+// channel receiving its updates, monitoring stops when the test ends
+func monitorNetns(t *testing.T, opts MonitorOptions, path string) <-chan *Update {
+	t.Helper()
+	opts.Netns = path
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan *Update, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := MonitorContext(ctx, opts, func(ctx context.Context, u *Update) error {
+			select {
+			case updates <- u:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			t.Errorf("MonitorContext: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return updates
+}
+
+// waitUpdate returns the first update match reports true for
+func waitUpdate(t *testing.T, updates <-chan *Update, match func(*Update) bool) *Update {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-updates:
+			if match(u) {
+				return u
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for update")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ipmon
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// PatchOp is an operation of a JSON Patch document as defined by RFC 6902
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch returns the JSON Patch that turns the JSON representation of
+// prev into that of cur. Objects are compared member by member, arrays
+// that differ are replaced as a whole.
+func JSONPatch(prev, cur *Update) ([]PatchOp, error) {
+	a, err := toJSONValue(prev)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toJSONValue(cur)
+	if err != nil {
+		return nil, err
+	}
+	ops := []PatchOp{}
+	if err := diffJSON("", a, b, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func toJSONValue(u *Update) (any, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+// patchPointer escapes an object member name for a JSON Pointer
+var patchPointer = strings.NewReplacer("~", "~0", "/", "~1")
+
+func diffJSON(path string, a, b any, ops *[]PatchOp) error {
+	am, aok := a.(map[string]any)
+	bm, bok := b.(map[string]any)
+	if !aok || !bok {
+		if reflect.DeepEqual(a, b) {
+			return nil
+		}
+		return addOp(ops, "replace", path, b)
+	}
+	keys := make([]string, 0, len(am)+len(bm))
+	for k := range am {
+		keys = append(keys, k)
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := path + "/" + patchPointer.Replace(k)
+		av, inA := am[k]
+		bv, inB := bm[k]
+		var err error
+		switch {
+		case !inB:
+			*ops = append(*ops, PatchOp{Op: "remove", Path: p})
+		case !inA:
+			err = addOp(ops, "add", p, bv)
+		default:
+			err = diffJSON(p, av, bv, ops)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addOp(ops *[]PatchOp, op, path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	*ops = append(*ops, PatchOp{Op: op, Path: path, Value: b})
+	return nil
+}
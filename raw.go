@@ -0,0 +1,96 @@
+package ipmon
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Raw describes the netlink message that triggered an update, see
+// MonitorOptions.IncludeRaw
+type Raw struct {
+	// Type is the message type, e.g. RTM_NEWROUTE
+	Type string `json:"type"`
+	// Flags holds the names of the netlink header flags, or the address
+	// flags for address messages
+	Flags []string `json:"flags,omitempty"`
+}
+
+type flagName struct {
+	flag int
+	name string
+}
+
+var msgTypeNames = map[uint16]string{
+	unix.RTM_NEWLINK:  "RTM_NEWLINK",
+	unix.RTM_DELLINK:  "RTM_DELLINK",
+	unix.RTM_NEWADDR:  "RTM_NEWADDR",
+	unix.RTM_DELADDR:  "RTM_DELADDR",
+	unix.RTM_NEWROUTE: "RTM_NEWROUTE",
+	unix.RTM_DELROUTE: "RTM_DELROUTE",
+	unix.RTM_NEWRULE:  "RTM_NEWRULE",
+	unix.RTM_DELRULE:  "RTM_DELRULE",
+}
+
+var nlmsgFlagNames = []flagName{
+	{unix.NLM_F_MULTI, "NLM_F_MULTI"},
+	{unix.NLM_F_ACK, "NLM_F_ACK"},
+	{unix.NLM_F_ECHO, "NLM_F_ECHO"},
+	{unix.NLM_F_REPLACE, "NLM_F_REPLACE"},
+	{unix.NLM_F_EXCL, "NLM_F_EXCL"},
+	{unix.NLM_F_CREATE, "NLM_F_CREATE"},
+	{unix.NLM_F_APPEND, "NLM_F_APPEND"},
+}
+
+var addrFlagNames = []flagName{
+	{unix.IFA_F_SECONDARY, "IFA_F_SECONDARY"},
+	{unix.IFA_F_NODAD, "IFA_F_NODAD"},
+	{unix.IFA_F_OPTIMISTIC, "IFA_F_OPTIMISTIC"},
+	{unix.IFA_F_DADFAILED, "IFA_F_DADFAILED"},
+	{unix.IFA_F_HOMEADDRESS, "IFA_F_HOMEADDRESS"},
+	{unix.IFA_F_DEPRECATED, "IFA_F_DEPRECATED"},
+	{unix.IFA_F_TENTATIVE, "IFA_F_TENTATIVE"},
+	{unix.IFA_F_PERMANENT, "IFA_F_PERMANENT"},
+	{unix.IFA_F_MANAGETEMPADDR, "IFA_F_MANAGETEMPADDR"},
+	{unix.IFA_F_NOPREFIXROUTE, "IFA_F_NOPREFIXROUTE"},
+	{unix.IFA_F_MCAUTOJOIN, "IFA_F_MCAUTOJOIN"},
+	{unix.IFA_F_STABLE_PRIVACY, "IFA_F_STABLE_PRIVACY"},
+}
+
+func msgTypeName(t uint16) string {
+	if name, ok := msgTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", t)
+}
+
+func flagNames(flags int, names []flagName) (s []string) {
+	for _, f := range names {
+		if flags&f.flag != 0 {
+			s = append(s, f.name)
+		}
+	}
+	return
+}
+
+func rawAddr(a netlink.AddrUpdate) *Raw {
+	r := &Raw{Type: "RTM_DELADDR", Flags: flagNames(a.Flags, addrFlagNames)}
+	if a.NewAddr {
+		r.Type = "RTM_NEWADDR"
+	}
+	return r
+}
+
+func rawLink(l netlink.LinkUpdate) *Raw {
+	return &Raw{
+		Type:  msgTypeName(l.Header.Type),
+		Flags: flagNames(int(l.Header.Flags), nlmsgFlagNames),
+	}
+}
+
+func rawRoute(r netlink.RouteUpdate) *Raw {
+	return &Raw{
+		Type:  msgTypeName(r.Type),
+		Flags: flagNames(int(r.NlFlags), nlmsgFlagNames),
+	}
+}
@@ -0,0 +1,212 @@
+package ipmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RouteFor asks the kernel which route would be used to reach dst and
+// returns it including the selected source address and egress interface
+func RouteFor(dst net.IP) (*Route, error) {
+	routes, err := netlink.RouteGet(dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no route to %s", dst)
+	}
+	route := routes[0]
+	r := &Route{
+		route:       route,
+		Destination: dst.String(),
+	}
+	if route.Gw != nil {
+		r.Gateway = route.Gw.String()
+	}
+	if route.Src != nil {
+		r.Src = route.Src.String()
+	}
+	if lnk, err := netlink.LinkByIndex(route.LinkIndex); err == nil && lnk.Attrs() != nil {
+		r.Link = lnk.Attrs().Name
+	}
+	return r, nil
+}
+
+// PreferredSource returns the source address and egress interface the
+// kernel selects for traffic to dst, following its RFC 6724 source address
+// selection for IPv6
+func PreferredSource(dst net.IP) (net.IP, string, error) {
+	r, err := RouteFor(dst)
+	if err != nil {
+		return nil, "", err
+	}
+	if r.route.Src == nil {
+		return nil, r.Link, fmt.Errorf("no source address for %s", dst)
+	}
+	return r.route.Src, r.Link, nil
+}
+
+// isDefault reports whether dst is a default route destination, netlink
+// reports these either without a destination or as a zero length prefix
+func isDefault(dst *net.IPNet) bool {
+	if dst == nil {
+		return true
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+var routeProtocols = map[string]netlink.RouteProtocol{
+	"redirect":   unix.RTPROT_REDIRECT,
+	"kernel":     unix.RTPROT_KERNEL,
+	"boot":       unix.RTPROT_BOOT,
+	"static":     unix.RTPROT_STATIC,
+	"ra":         unix.RTPROT_RA,
+	"zebra":      unix.RTPROT_ZEBRA,
+	"bird":       unix.RTPROT_BIRD,
+	"dhcp":       unix.RTPROT_DHCP,
+	"keepalived": unix.RTPROT_KEEPALIVED,
+	"babel":      unix.RTPROT_BABEL,
+	"bgp":        unix.RTPROT_BGP,
+	"isis":       unix.RTPROT_ISIS,
+	"ospf":       unix.RTPROT_OSPF,
+	"rip":        unix.RTPROT_RIP,
+	"eigrp":      unix.RTPROT_EIGRP,
+}
+
+// ParseRouteProtocol returns the route protocol for a name as used by
+// ip(8) or a number
+func ParseRouteProtocol(name string) (netlink.RouteProtocol, error) {
+	if p, ok := routeProtocols[name]; ok {
+		return p, nil
+	}
+	if n, err := strconv.ParseUint(name, 10, 8); err == nil {
+		return netlink.RouteProtocol(n), nil
+	}
+	return 0, fmt.Errorf("unknown route protocol %q", name)
+}
+
+// wantProtocol reports whether routes installed by p are included in
+// snapshots and trigger updates
+func (m *monitor) wantProtocol(p netlink.RouteProtocol) bool {
+	for _, x := range m.opts.ExcludeRouteProtocols {
+		if p == x {
+			return false
+		}
+	}
+	if len(m.opts.RouteProtocols) == 0 {
+		return true
+	}
+	for _, x := range m.opts.RouteProtocols {
+		if p == x {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON decodes a route and restores the netlink fields used to
+// derive default route variables, so that updates read back from JSON
+// marshal to the same environment
+func (r *Route) UnmarshalJSON(b []byte) error {
+	type route Route
+	var v route
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Route(v)
+	r.route = netlink.Route{
+		LinkIndex: r.LinkIndex,
+		Table:     r.Table,
+		Priority:  r.Metric,
+		Gw:        net.ParseIP(r.Gateway),
+		Src:       net.ParseIP(r.Src),
+		Family:    netlink.FAMILY_V4,
+	}
+	if r.Destination != "default" && r.Destination != "" {
+		_, dst, err := net.ParseCIDR(r.Destination)
+		if err != nil {
+			return err
+		}
+		r.route.Dst = dst
+	}
+	for _, ip := range []net.IP{r.route.Gw, r.route.Src} {
+		if ip != nil && ip.To4() == nil {
+			r.route.Family = netlink.FAMILY_V6
+		}
+	}
+	if r.route.Dst != nil && r.route.Dst.IP.To4() == nil {
+		r.route.Family = netlink.FAMILY_V6
+	}
+	return nil
+}
+
+// recentRoutes maps recently added or removed default routes, keyed by
+// defaultRouteKey, to their metric
+type recentRoutes map[string]recentRoute
+
+type recentRoute struct {
+	metric int
+	at     time.Time
+}
+
+// defaultRouteKey identifies a default route regardless of its metric
+func defaultRouteKey(r netlink.Route) string {
+	return fmt.Sprintf("%d %d %s %d", r.Family, r.Table, r.Gw, r.LinkIndex)
+}
+
+// add remembers a default route and forgets those seen longer than
+// removedAddrWindow ago
+func (rr recentRoutes) add(r netlink.Route) {
+	now := time.Now()
+	for k, v := range rr {
+		if now.Sub(v.at) > removedAddrWindow {
+			delete(rr, k)
+		}
+	}
+	rr[defaultRouteKey(r)] = recentRoute{metric: r.Priority, at: now}
+}
+
+// take returns and forgets the metric of the route recorded for the key
+// of r when it was seen recently and has another metric than r
+func (rr recentRoutes) take(r netlink.Route) (int, bool) {
+	key := defaultRouteKey(r)
+	rc, ok := rr[key]
+	if !ok || rc.metric == r.Priority {
+		return 0, false
+	}
+	delete(rr, key)
+	return rc.metric, time.Since(rc.at) <= removedAddrWindow
+}
+
+// metricChanged reports the previous and new metric when the default
+// route event a moves a route with the same family, table, gateway and
+// interface to another metric. That is a route removed shortly before one
+// with another metric is added, or a route removed shortly after one with
+// another metric was added that is still present in cur. Other default
+// route events are recorded in removed and added, so that a backup route
+// added next to an existing one is not taken for a metric change.
+func metricChanged(a netlink.RouteUpdate, cur *Update, removed, added recentRoutes) (old, metric int, ok bool) {
+	if a.Type != unix.RTM_DELROUTE {
+		if old, ok := removed.take(a.Route); ok {
+			return old, a.Priority, true
+		}
+		added.add(a.Route)
+		return 0, 0, false
+	}
+	if metric, ok := added.take(a.Route); ok {
+		key := defaultRouteKey(a.Route)
+		for _, r := range cur.Routes {
+			if isDefault(r.route.Dst) && defaultRouteKey(r.route) == key && r.route.Priority == metric {
+				return a.Priority, metric, true
+			}
+		}
+	}
+	removed.add(a.Route)
+	return 0, 0, false
+}
@@ -0,0 +1,73 @@
+package ipmon
+
+import (
+	"github.com/vishvananda/netlink"
+	"net"
+	"testing"
+)
+
+// TestMetricChange adds a backup default route next to an existing one,
+// which is a plain add, and then removes the original, which moves the
+// default route to the backup metric
+func TestMetricChange(t *testing.T) {
+	path, h := testNetns(t)
+	link := testLink(t, h, "ipmon0")
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatalf("LinkSetUp: %v", err)
+	}
+	mustAddr(t, h, link, "192.0.2.2/24")
+	route := func(metric int) *netlink.Route {
+		return &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("192.0.2.1"), Priority: metric}
+	}
+	if err := h.RouteAdd(route(100)); err != nil {
+		t.Fatalf("RouteAdd: %v", err)
+	}
+	updates := monitorNetns(t, DefaultMonitorOptions(), path)
+	waitUpdate(t, updates, func(u *Update) bool { return u.Type == "init" })
+
+	if err := h.RouteAdd(route(50)); err != nil {
+		t.Fatalf("RouteAdd: %v", err)
+	}
+	u := waitUpdate(t, updates, func(u *Update) bool { return u.Type == "default_route" })
+	if hasChange(u, "metric_change") {
+		t.Errorf("backup route reported as metric change: %v", u.Change)
+	}
+
+	if err := h.RouteDel(route(100)); err != nil {
+		t.Fatalf("RouteDel: %v", err)
+	}
+	u = waitUpdate(t, updates, func(u *Update) bool { return u.Type == "default_route" })
+	if !hasChange(u, "metric_change") || u.OldMetric != 100 || u.Metric != 50 {
+		t.Errorf("removing old route: change %v metric %d old %d, want metric_change 50 old 100", u.Change, u.Metric, u.OldMetric)
+	}
+}
+
+// TestMetricChangeReplace removes the default route before adding it back
+// with another metric
+func TestMetricChangeReplace(t *testing.T) {
+	path, h := testNetns(t)
+	link := testLink(t, h, "ipmon0")
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatalf("LinkSetUp: %v", err)
+	}
+	mustAddr(t, h, link, "192.0.2.2/24")
+	route := func(metric int) *netlink.Route {
+		return &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("192.0.2.1"), Priority: metric}
+	}
+	if err := h.RouteAdd(route(100)); err != nil {
+		t.Fatalf("RouteAdd: %v", err)
+	}
+	updates := monitorNetns(t, DefaultMonitorOptions(), path)
+	waitUpdate(t, updates, func(u *Update) bool { return u.Type == "init" })
+
+	if err := h.RouteDel(route(100)); err != nil {
+		t.Fatalf("RouteDel: %v", err)
+	}
+	if err := h.RouteAdd(route(50)); err != nil {
+		t.Fatalf("RouteAdd: %v", err)
+	}
+	u := waitUpdate(t, updates, func(u *Update) bool { return u.Type == "default_route" && !hasChange(u, "delete") })
+	if !hasChange(u, "metric_change") || u.OldMetric != 100 || u.Metric != 50 {
+		t.Errorf("change %v metric %d old %d, want metric_change 50 old 100", u.Change, u.Metric, u.OldMetric)
+	}
+}
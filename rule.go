@@ -0,0 +1,106 @@
+package ipmon
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+type Rule struct {
+	Priority int    `json:"priority"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Table    int    `json:"table"`
+	Mark     int    `json:"fwmark,omitempty"`
+	// TableName is the name of Table from rt_tables, or the number when
+	// it has no name
+	TableName string `json:"table_name,omitempty"`
+}
+
+func (r *Rule) String() string {
+	s := fmt.Sprintf("%d:", r.Priority)
+	if r.From != "" {
+		s += " from " + r.From
+	} else {
+		s += " from all"
+	}
+	if r.To != "" {
+		s += " to " + r.To
+	}
+	if r.Mark != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.Mark)
+	}
+	if r.TableName != "" {
+		return s + " lookup " + r.TableName
+	}
+	return s + fmt.Sprintf(" lookup %d", r.Table)
+}
+
+// ruleSubscribe sends the message type of every policy routing rule change
+// to ch until done is closed, netlink has no parsed rule updates so the
+// receiver is expected to list the rules again
+func ruleSubscribe(ns *netns.NsHandle, ch chan<- uint16, done <-chan struct{}, logf func(string, ...any)) error {
+	newNs := netns.None()
+	if ns != nil {
+		newNs = *ns
+	}
+	s, err := nl.SubscribeAt(newNs, netns.None(), unix.NETLINK_ROUTE, unix.RTNLGRP_IPV4_RULE, unix.RTNLGRP_IPV6_RULE)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, from, err := s.Receive()
+			if err != nil {
+				logf("rule subscription: %v", err)
+				return
+			}
+			if from.Pid != nl.PidKernel {
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != unix.RTM_NEWRULE && m.Header.Type != unix.RTM_DELRULE {
+					continue
+				}
+				select {
+				case ch <- m.Header.Type:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *monitor) listRules() (rules []*Rule) {
+	list, err := m.h.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		m.logf("RuleList: %v", err)
+		return nil
+	}
+	for _, r := range list {
+		rule := &Rule{
+			Priority: r.Priority,
+			Table:    r.Table,
+			Mark:     int(r.Mark),
+
+			TableName: tableName(m.tables, r.Table),
+		}
+		if r.Src != nil {
+			rule.From = r.Src.String()
+		}
+		if r.Dst != nil {
+			rule.To = r.Dst.String()
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
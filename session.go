@@ -0,0 +1,95 @@
+package ipmon
+
+import (
+	"context"
+	"sync"
+)
+
+// SubscriberBuffer is the number of updates buffered per subscriber of a
+// Session, when a subscriber falls behind the oldest update is dropped
+const SubscriberBuffer = 16
+
+// Session runs a monitor and delivers every update to any number of
+// subscribers, decoupling the consumers from the netlink event loop
+type Session struct {
+	opts MonitorOptions
+
+	mu   sync.Mutex
+	subs map[chan *Update]struct{}
+	done bool
+}
+
+// NewSession returns a session that monitors with opts once Run is called
+func NewSession(opts MonitorOptions) *Session {
+	return &Session{
+		opts: opts,
+		subs: map[chan *Update]struct{}{},
+	}
+}
+
+// Subscribe returns a channel receiving every update from now on and a
+// function that ends the subscription. Subscribers get separate copies of
+// each update. The channel is closed when the
+// subscription is cancelled or Run returns.
+func (s *Session) Subscribe() (<-chan *Update, func()) {
+	ch := make(chan *Update, SubscriberBuffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		close(ch)
+		return ch, func() {}
+	}
+	s.subs[ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Run monitors until ctx is cancelled or monitoring fails and closes the
+// channels of all subscribers before returning
+func (s *Session) Run(ctx context.Context) error {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for ch := range s.subs {
+			close(ch)
+		}
+		s.subs = map[chan *Update]struct{}{}
+		s.done = true
+	}()
+	return MonitorContext(ctx, s.opts, func(_ context.Context, u *Update) error {
+		s.publish(u)
+		return nil
+	})
+}
+
+func (s *Session) publish(u *Update) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for ch := range s.subs {
+		// every subscriber owns its update, the copies are taken from u
+		// before it is handed to the last subscriber
+		c := u
+		if i++; i < len(s.subs) {
+			c = u.Clone()
+		}
+		select {
+		case ch <- c:
+			continue
+		default:
+		}
+		// the buffer is full, drop the oldest update to make room. Only
+		// publish sends and it holds mu, so the send cannot block.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- c
+	}
+}
@@ -0,0 +1,193 @@
+package ipmon
+
+import (
+	"context"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionSubscribersOwnUpdates modifies every update received by
+// several subscribers, run it with -race to catch updates shared between
+// them
+func TestSessionSubscribersOwnUpdates(t *testing.T) {
+	path, h := testNetns(t)
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultMonitorOptions()
+	opts.Netns = path
+	s := NewSession(opts)
+
+	const subs, addrs = 3, 10
+	last := fmt.Sprintf("10.0.0.%d", addrs)
+	var started, finished, wg sync.WaitGroup
+	for i := 0; i < subs; i++ {
+		ch, _ := s.Subscribe()
+		started.Add(1)
+		finished.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first, done := true, false
+			for u := range ch {
+				if first {
+					started.Done()
+					first = false
+				}
+				if lo := u.Interfaces["lo"]; lo != nil && !done {
+					for _, a := range lo.Addr {
+						if a.Address == last {
+							finished.Done()
+							done = true
+							break
+						}
+					}
+				}
+				u.Change = append(u.Change, "seen")
+				for _, inf := range u.Interfaces {
+					inf.Addr = append(inf.Addr, &Address{})
+				}
+				u.Routes = nil
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	wait := func(wg *sync.WaitGroup, what string) {
+		ok := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(ok)
+		}()
+		select {
+		case <-ok:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+	wait(&started, "initial update")
+	for i := 1; i <= addrs; i++ {
+		mustAddr(t, h, lo, fmt.Sprintf("10.0.0.%d/32", i))
+	}
+	wait(&finished, "address updates")
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	wg.Wait()
+}
+
+// TestSessionSlowSubscriber injects address events from several goroutines
+// while one subscriber blocks on every update, run it with -race. The slow
+// subscriber falls behind and has its oldest updates dropped but must
+// still end up with the latest state.
+func TestSessionSlowSubscriber(t *testing.T) {
+	path, h := testNetns(t)
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultMonitorOptions()
+	opts.Netns = path
+	s := NewSession(opts)
+
+	const workers, addrs = 4, 2 * SubscriberBuffer
+	hasAll := func(u *Update) bool {
+		lo := u.Interfaces["lo"]
+		if lo == nil {
+			return false
+		}
+		n := 0
+		for _, a := range lo.Addr {
+			if strings.HasPrefix(a.Address, "10.") {
+				n++
+			}
+		}
+		return n == workers*addrs
+	}
+	fast, _ := s.Subscribe()
+	slow, _ := s.Subscribe()
+	started := make(chan struct{})
+	fastDone, slowDone := make(chan int), make(chan int)
+	go func() {
+		n, all := 0, false
+		for u := range fast {
+			if n++; n == 1 {
+				close(started)
+			}
+			if !all && hasAll(u) {
+				all = true
+				fastDone <- n
+			}
+			u.Change = append(u.Change, "seen")
+		}
+	}()
+	go func() {
+		n, all := 0, false
+		for u := range slow {
+			n++
+			time.Sleep(20 * time.Millisecond)
+			if !all && hasAll(u) {
+				all = true
+				slowDone <- n
+			}
+			for _, inf := range u.Interfaces {
+				inf.Addr = nil
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for initial update")
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i <= addrs; i++ {
+				addr, err := netlink.ParseAddr(fmt.Sprintf("10.%d.0.%d/32", w, i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := h.AddrAdd(lo, addr); err != nil {
+					t.Errorf("AddrAdd %s: %v", addr, err)
+					return
+				}
+				// the monitor reads a full snapshot per event, pace
+				// the events so that they are not all in the first one
+				time.Sleep(2 * time.Millisecond)
+			}
+		}(w)
+	}
+	wg.Wait()
+	var nfast, nslow int
+	for nfast == 0 || nslow == 0 {
+		select {
+		case nfast = <-fastDone:
+		case nslow = <-slowDone:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for all addresses, fast %d slow %d", nfast, nslow)
+		}
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if nslow >= nfast {
+		t.Logf("slow subscriber got %d updates, fast %d, nothing was dropped", nslow, nfast)
+	}
+}
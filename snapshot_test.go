@@ -0,0 +1,79 @@
+package ipmon
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"testing"
+)
+
+// TestSnapshotConcurrentDelete takes snapshots while links are created
+// and removed, every snapshot must be consistent with the links it lists
+func TestSnapshotConcurrentDelete(t *testing.T) {
+	path, h := testNetns(t)
+	kind := testLink(t, h, "ipmon0").Type()
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	mh, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mh.Close()
+	m := &monitor{opts: DefaultMonitorOptions(), h: mh, tables: readTableNames()}
+
+	stop := make(chan struct{})
+	churned := make(chan error, 1)
+	go func() {
+		churned <- func() error {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return nil
+				default:
+				}
+				attrs := netlink.LinkAttrs{Name: fmt.Sprintf("churn%d", i%4)}
+				var link netlink.Link = &netlink.Dummy{LinkAttrs: attrs}
+				if kind == "ifb" {
+					link = &netlink.Ifb{LinkAttrs: attrs}
+				}
+				if err := h.LinkAdd(link); err != nil {
+					return fmt.Errorf("LinkAdd: %w", err)
+				}
+				if err := h.LinkSetUp(link); err != nil {
+					return fmt.Errorf("LinkSetUp: %w", err)
+				}
+				addr, _ := netlink.ParseAddr(fmt.Sprintf("10.%d.0.1/24", i%4))
+				if err := h.AddrAdd(link, addr); err != nil {
+					return fmt.Errorf("AddrAdd: %w", err)
+				}
+				if err := h.LinkDel(link); err != nil {
+					return fmt.Errorf("LinkDel: %w", err)
+				}
+			}
+		}()
+	}()
+
+	for i := 0; i < 200; i++ {
+		u, err := m.genUpdate(nil)
+		if err != nil {
+			t.Fatalf("genUpdate: %v", err)
+		}
+		for idx, name := range u.linkNames {
+			if inf := u.Interfaces[name]; inf == nil || inf.Index != idx {
+				t.Errorf("link %d %s has interface %+v", idx, name, inf)
+			}
+		}
+		for _, r := range u.Routes {
+			if r.LinkIndex > 0 && u.Interfaces[r.Link] == nil {
+				t.Errorf("route %s via unknown link %d", r.Destination, r.LinkIndex)
+			}
+		}
+	}
+	close(stop)
+	if err := <-churned; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package ipmon
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rtTablesFiles are read in order, later entries override earlier ones
+var rtTablesFiles = []string{
+	"/usr/share/iproute2/rt_tables",
+	"/etc/iproute2/rt_tables",
+}
+
+// readTableNames returns the route table names configured for ip(8),
+// including the reserved tables
+func readTableNames() map[int]string {
+	names := map[int]string{
+		0:   "unspec",
+		253: "default",
+		254: "main",
+		255: "local",
+	}
+	files := append([]string{}, rtTablesFiles...)
+	if extra, err := filepath.Glob("/etc/iproute2/rt_tables.d/*.conf"); err == nil {
+		files = append(files, extra...)
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			id, err := strconv.ParseUint(fields[0], 0, 32)
+			if err != nil {
+				continue
+			}
+			names[int(id)] = fields[1]
+		}
+		_ = f.Close()
+	}
+	return names
+}
+
+// tableName returns the name of table id or the number if it has none
+func tableName(names map[int]string, id int) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return strconv.Itoa(id)
+}
@@ -0,0 +1,28 @@
+// Package wireguard reads WireGuard device info with wgctrl for
+// ipmon.MonitorOptions.WireGuardInfo. It is a module of its own so that
+// bonan.se/ipmon does not depend on wgctrl.
+package wireguard
+
+import (
+	"bonan.se/ipmon"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Info returns the listening port and peer count of the WireGuard device
+// name in the current network namespace
+func Info(name string) (*ipmon.WireGuard, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	dev, err := c.Device(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ipmon.WireGuard{
+		ListenPort: dev.ListenPort,
+		Peers:      len(dev.Peers),
+	}, nil
+}